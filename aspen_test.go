@@ -1,8 +1,12 @@
 package aspen
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"crypto/sha1"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"go/parser"
 	"go/token"
@@ -11,6 +15,11 @@ import (
 	"log"
 	"math/rand"
 	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
@@ -56,6 +65,34 @@ ctx["D"] = &JDance{
     When: time.Now(),
 }
 response.SetBody(ctx["D"])
+`
+	basicSSESimplate = `
+import (
+    "time"
+)
+
+for i := 0; i < 3; i++ {
+    err = events.Send("tick", time.Now())
+    if err != nil {
+        break
+    }
+}
+`
+	basicWebSocketSimplate = `
+import (
+    "strings"
+)
+
+socket.OnMessage(func(msg *aspen.WebSocketMessage) {
+    socket.SendText(strings.ToUpper(msg.Text()))
+})
+`
+	basicInboundHook = `
+import (
+    "strings"
+)
+
+ctx["Shouting"] = strings.ToUpper(request.URL.Path)
 `
 	basicNegotiatedSimplate = `
 import (
@@ -262,6 +299,23 @@ func TestRenderedSimplateKnowsItsOutputName(t *testing.T) {
 	}
 }
 
+func TestOutputNamesKeepLeadingPunctuation(t *testing.T) {
+	names := map[string]bool{}
+
+	for _, filename := range []string{"/tmp/_foo.txt", "/tmp/foo.txt"} {
+		s, err := newSimplateFromString("aspen_go_gen", "/tmp", filename, basicRenderedTxtSimplate)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names[s.OutputName()] = true
+	}
+
+	if len(names) != 2 {
+		t.Errorf("Distinct simplates share an output name: %v", names)
+	}
+}
+
 func TestDetectsRenderedSimplate(t *testing.T) {
 	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic-rendered.txt", basicRenderedTxtSimplate)
 	if err != nil {
@@ -763,3 +817,2459 @@ func TestNewSiteBuilderCompilesSources(t *testing.T) {
 			serverBinary, fi.Mode())
 	}
 }
+
+func orderMiddleware(name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Add("X-Order", name)
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+func TestMiddlewareRunsInStageAndRegistrationOrder(t *testing.T) {
+	site := DeclareWebsite("aspen_test_middleware_order")
+	site.UseAt(BeforeStatic, "/", orderMiddleware("static"))
+	site.Use(orderMiddleware("first"), orderMiddleware("second"))
+	site.UseAt(BeforePattern, "/", orderMiddleware("pattern"))
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/no/such/thing.txt", nil)
+	site.ph.ServeHTTP(rec, req)
+
+	order := strings.Join(rec.Header()["X-Order"], ",")
+	if order != "first,second,pattern,static" {
+		t.Errorf("Middleware ran in unexpected order: %q", order)
+	}
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status code after middleware: %v", rec.Code)
+	}
+}
+
+func TestMiddlewareCanBeLimitedToPathPrefix(t *testing.T) {
+	site := DeclareWebsite("aspen_test_middleware_prefix")
+	site.UsePrefix("/api", orderMiddleware("api"))
+
+	for reqPath, expected := range map[string]bool{
+		"/api":           true,
+		"/api/":          true,
+		"/api/nope.json": true,
+		"/apiary":        false,
+		"/api-docs/":     false,
+		"/nope.json":     false,
+	} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqPath, nil)
+		site.ph.ServeHTTP(rec, req)
+
+		if ran := rec.Header().Get("X-Order") == "api"; ran != expected {
+			t.Errorf("Prefix middleware ran for %q: %v", reqPath, ran)
+		}
+	}
+}
+
+func TestMiddlewareCanShortCircuitPipeline(t *testing.T) {
+	site := DeclareWebsite("aspen_test_middleware_short")
+	site.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		})
+	})
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/anything", nil)
+	site.ph.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Middleware failed to short-circuit pipeline: %v", rec.Code)
+	}
+}
+
+func TestSiteHookKnowsItsPages(t *testing.T) {
+	h, err := newSiteHookFromString("aspen_go_gen", "/tmp",
+		"/tmp/.aspen/hooks/inbound.go", HookKindInbound, basicInboundHook)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if h.InitPage == nil || !strings.Contains(h.InitPage.Body, "strings") {
+		t.Errorf("Hook init page not assigned!: %v", h.InitPage)
+	}
+
+	if h.LogicPage == nil || !strings.Contains(h.LogicPage.Body, "ctx[") {
+		t.Errorf("Hook logic page not assigned!: %v", h.LogicPage)
+	}
+}
+
+func TestSiteHookRejectsTooManyPages(t *testing.T) {
+	_, err := newSiteHookFromString("aspen_go_gen", "/tmp",
+		"/tmp/.aspen/hooks/inbound.go", HookKindInbound, "\f\n\f\n")
+	if err == nil {
+		t.Errorf("Hook with three pages was not rejected!")
+	}
+}
+
+func TestSiteHookOutputIsValidGoSource(t *testing.T) {
+	h, err := newSiteHookFromString("aspen_go_gen", "/tmp",
+		"/tmp/.aspen/hooks/inbound.go", HookKindInbound, basicInboundHook)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var out bytes.Buffer
+	err = h.Execute(&out)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	fset := token.NewFileSet()
+	_, err = parser.ParseFile(fset, h.OutputName(), out.Bytes(), parser.DeclarationErrors)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInboundHooksCanShortCircuit(t *testing.T) {
+	site := DeclareWebsite("aspen_test_hooks_short")
+	ran := []string{}
+
+	site.AddInboundHook(func(request *http.Request,
+		response *HTTPResponseWrapper, ctx map[string]interface{}) error {
+
+		ran = append(ran, "first")
+		ctx["User"] = "someone"
+		response.SetStatusCode(http.StatusForbidden)
+		response.Finish()
+		return nil
+	})
+	site.AddInboundHook(func(request *http.Request,
+		response *HTTPResponseWrapper, ctx map[string]interface{}) error {
+
+		ran = append(ran, "second")
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	response := site.NewHTTPResponseWrapper(rec, req)
+	ctx := map[string]interface{}{}
+
+	if !site.RunInboundHooks(req, response, ctx) {
+		t.Errorf("Inbound hooks did not short-circuit")
+	}
+
+	if strings.Join(ran, ",") != "first" {
+		t.Errorf("Unexpected hooks ran: %v", ran)
+	}
+
+	if ctx["User"] != "someone" {
+		t.Errorf("Inbound hook did not populate ctx: %v", ctx)
+	}
+
+	response.Respond()
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Short-circuited response has wrong status: %v", rec.Code)
+	}
+}
+
+func TestOutboundHookErrorBecomes500(t *testing.T) {
+	site := DeclareWebsite("aspen_test_hooks_outbound")
+	site.AddOutboundHook(func(request *http.Request,
+		response *HTTPResponseWrapper, ctx map[string]interface{}) error {
+
+		return errors.New("nope")
+	})
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	response := site.NewHTTPResponseWrapper(rec, req)
+	response.SetBody(map[string]string{"ok": "yes"})
+
+	site.RunOutboundHooks(req, response, map[string]interface{}{})
+	response.RespondJSON()
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Outbound hook error did not become a 500: %v", rec.Code)
+	}
+}
+
+func TestOutboundHooksAreSkippedForStreamedResponses(t *testing.T) {
+	ran := false
+	site := DeclareWebsite("aspen_test_hooks_outbound_streamed")
+	site.AddOutboundHook(func(request *http.Request,
+		response *HTTPResponseWrapper, ctx map[string]interface{}) error {
+
+		ran = true
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	response := site.NewHTTPResponseWrapper(rec, req)
+	response.Writer().Write([]byte("streamed"))
+
+	site.RunOutboundHooks(req, response, map[string]interface{}{})
+	response.Respond()
+
+	if ran || rec.Body.String() != "streamed" {
+		t.Errorf("Outbound hook ran after streaming %q", rec.Body.String())
+	}
+}
+
+func TestTreeWalkerSkipsSiteConfigDir(t *testing.T) {
+	siteRoot := mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	hookPath := path.Join(siteRoot, SiteHooksDirname, "inbound.go")
+	err := os.MkdirAll(path.Dir(hookPath), os.ModeDir|os.ModePerm)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ioutil.WriteFile(hookPath, []byte(basicInboundHook), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tw, err := newTreeWalker("aspen_go_gen", siteRoot)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	simplates, err := tw.Simplates()
+	if err != nil {
+		t.Error(err)
+	}
+
+	for simplate := range simplates {
+		if strings.HasPrefix(simplate.Filename, SiteConfigDirname) {
+			t.Errorf("Tree walker yielded site config file %q", simplate.Filename)
+		}
+	}
+}
+
+func TestStringMatchRegistersNonIndexSimplates(t *testing.T) {
+	site := DeclareWebsite("aspen_test_strmatch_nonindex")
+	site.RegisterSimplate(SimplateTypeRendered, "/tmp", "/shill/cans.txt",
+		func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/shill/cans.txt", nil)
+	site.ph.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusTeapot {
+		t.Errorf("Rendered simplate not served at its own path: %v", rec.Code)
+	}
+}
+
+func TestMountServesPathsBeneathPrefix(t *testing.T) {
+	site := DeclareWebsite("aspen_test_mount_serves")
+	err := site.Mount("/admin/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	site.RegisterSimplate(SimplateTypeRendered, "/tmp", "/admin/special.txt",
+		func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		})
+
+	for reqPath, expected := range map[string]int{
+		"/admin":             http.StatusTeapot,
+		"/admin/":            http.StatusTeapot,
+		"/admin/users/1":     http.StatusTeapot,
+		"/admin/special.txt": http.StatusAccepted,
+		"/administrivia":     http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqPath, nil)
+		site.ph.ServeHTTP(rec, req)
+
+		if rec.Code != expected {
+			t.Errorf("%q served with %v instead of %v", reqPath, rec.Code, expected)
+		}
+	}
+}
+
+func TestMountDetectsConflicts(t *testing.T) {
+	site := DeclareWebsite("aspen_test_mount_conflicts")
+	noop := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	site.RegisterSimplate(SimplateTypeRendered, "/tmp", "/falafel/index.html", noop)
+	site.RegisterSimplate(SimplateTypeRendered, "/tmp",
+		"/shawarma/%topping/with/%pairing.txt", noop)
+
+	if site.Mount("/falafel/", noop) == nil {
+		t.Errorf("Mount over string match route was not rejected")
+	}
+
+	if site.Mount("/shawarma", noop) == nil {
+		t.Errorf("Mount shadowing pattern route was not rejected")
+	}
+
+	if site.Mount("/metrics", noop) != nil {
+		t.Errorf("Mount at unclaimed prefix was rejected")
+	}
+
+	if site.Mount("/metrics/", noop) == nil {
+		t.Errorf("Duplicate mount was not rejected")
+	}
+}
+
+func TestRootMountServesWhatNothingElseDoes(t *testing.T) {
+	mkTmpDir()
+	defer rmTmpDir()
+
+	ioutil.WriteFile(path.Join(tmpdir, "robots.txt"), []byte("static"), 0644)
+
+	site := DeclareWebsite("aspen_test_mount_root")
+	site.WwwRoot = tmpdir
+
+	served := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(name))
+		}
+	}
+
+	site.RegisterSimplate(SimplateTypeRendered, tmpdir, "/menu.html", served("menu"))
+	site.RegisterSimplate(SimplateTypeRendered, tmpdir,
+		"/shawarma/%topping/with/%pairing.txt", served("pattern"))
+
+	if err := site.Mount("/", served("root")); err != nil {
+		t.Fatalf("Root mount was rejected: %v", err)
+	}
+
+	if site.Mount("/", served("again")) == nil {
+		t.Errorf("Duplicate root mount was not rejected")
+	}
+
+	for reqPath, expected := range map[string]string{
+		"/menu.html":                     "menu",
+		"/shawarma/lamb/with/hummus.txt": "pattern",
+		"/robots.txt":                    "static",
+		"/legacy/app":                    "root",
+	} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqPath, nil)
+		site.ph.ServeHTTP(rec, req)
+
+		if rec.Body.String() != expected {
+			t.Errorf("%q served %q, expected %q", reqPath, rec.Body.String(), expected)
+		}
+	}
+}
+
+func TestRoutesListsMountsInPrecedenceOrder(t *testing.T) {
+	site := DeclareWebsite("aspen_test_mount_routes")
+	noop := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	site.RegisterSimplate(SimplateTypeRendered, "/tmp",
+		"/shawarma/%topping/with/%pairing.txt", noop)
+	site.RegisterSimplate(SimplateTypeRendered, "/tmp", "/flurb.txt", noop)
+	site.Mount("/metrics", noop)
+	site.Mount("/metrics/debug/", noop)
+
+	listing := []string{}
+	for _, route := range site.Routes() {
+		listing = append(listing, route.Kind+" "+route.RequestPath)
+	}
+
+	expected := "string /flurb.txt," +
+		"mount /metrics/debug/," +
+		"mount /metrics," +
+		"pattern /shawarma/%topping/with/%pairing.txt"
+	if strings.Join(listing, ",") != expected {
+		t.Errorf("Unexpected route listing: %v", listing)
+	}
+}
+
+func newTestSiteIndex() *siteIndex {
+	return &siteIndex{
+		WwwRoot: "/tmp",
+		Simplates: map[string]*simplateSummary{
+			"/falafel/index.html":                 {Type: SimplateTypeRendered},
+			"/falafel/%topping/with/%pairing.txt": {Type: SimplateTypeRendered},
+			"/octo":                               {Type: SimplateTypeNegotiated},
+			"/squid/index":                        {Type: SimplateTypeNegotiated},
+			"/Big CMS/flurb.txt":                  {Type: SimplateTypeStatic},
+		},
+	}
+}
+
+func TestURLForSubstitutesAndEscapesVirtualPathValues(t *testing.T) {
+	idx := newTestSiteIndex()
+
+	u, err := idx.URLFor("/falafel/%topping/with/%pairing.txt",
+		map[string]interface{}{"topping": 42, "pairing": "yo gurt", "hot": "very hot"},
+		DefaultIndicesArray)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if u != "/falafel/42/with/yo%20gurt.txt?hot=very+hot" {
+		t.Errorf("Unexpected URL: %q", u)
+	}
+}
+
+func TestURLForHandlesIndicesNegotiatedAndStaticSimplates(t *testing.T) {
+	idx := newTestSiteIndex()
+
+	for simplatePath, expected := range map[string]string{
+		"/falafel/index.html": "/falafel/",
+		"/octo.json":          "/octo.json",
+		"/squid/index":        "/squid/",
+		"/squid/index.json":   "/squid/index.json",
+		"/Big CMS/flurb.txt":  "/Big%20CMS/flurb.txt",
+	} {
+		u, err := idx.URLFor(simplatePath, nil, DefaultIndicesArray)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if u != expected {
+			t.Errorf("URL for %q is %q instead of %q", simplatePath, u, expected)
+		}
+	}
+}
+
+func TestURLForValuesAreRouted(t *testing.T) {
+	site := DeclareWebsite("aspen_test_urlfor_routed")
+	site.RegisterSimplate(SimplateTypeRendered, "/tmp", "/users/%id.json",
+		func(w http.ResponseWriter, req *http.Request) {
+			ctx := map[string]interface{}{}
+			site.UpdateContextFromVirtualPaths(&ctx, req.URL.Path, "/users/%id.json")
+			fmt.Fprint(w, ctx["id"])
+		})
+
+	idx := &siteIndex{Simplates: map[string]*simplateSummary{
+		"/users/%id.json": {Type: SimplateTypeRendered},
+	}}
+
+	for _, id := range []interface{}{42, "pars ley", "jo@example.com"} {
+		u, err := idx.URLFor("/users/%id.json", map[string]interface{}{"id": id},
+			DefaultIndicesArray)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", u, nil)
+		site.ph.ServeHTTP(rec, req)
+
+		if rec.Body.String() != fmt.Sprint(id) {
+			t.Errorf("%q for %q served %v %q", u, id, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestURLForRejectsUnknownRoutesAndMissingValues(t *testing.T) {
+	idx := newTestSiteIndex()
+
+	_, err := idx.URLFor("/shawarma.html", nil, DefaultIndicesArray)
+	if _, ok := err.(*unknownRouteError); !ok {
+		t.Errorf("Unknown route not rejected: %v", err)
+	}
+
+	_, err = idx.URLFor("/flurb.json", nil, DefaultIndicesArray)
+	if _, ok := err.(*unknownRouteError); !ok {
+		t.Errorf("Extension on non-negotiated route not rejected: %v", err)
+	}
+
+	_, err = idx.URLFor("/falafel/%topping/with/%pairing.txt",
+		map[string]interface{}{"topping": "parsley"}, DefaultIndicesArray)
+	if err == nil {
+		t.Errorf("Missing virtual path value not rejected")
+	}
+
+	for _, value := range []interface{}{"yo/gurt", ""} {
+		_, err = idx.URLFor("/falafel/%topping/with/%pairing.txt",
+			map[string]interface{}{"topping": value, "pairing": "yogurt"},
+			DefaultIndicesArray)
+		if err == nil {
+			t.Errorf("Unroutable virtual path value %q not rejected", value)
+		}
+	}
+}
+
+func TestTemplateRouteReferencesFindsLiteralRoutes(t *testing.T) {
+	refs, err := templateRouteReferences("test", `
+<a href="{{urlFor "/octo.json"}}">octo</a>
+{{if .Ok}}{{range .Items}}{{urlFor "/falafel/%topping/with/%pairing.txt" "topping" .}}{{end}}{{end}}
+{{urlFor .Dynamic}}`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if strings.Join(refs, ",") != "/octo.json,/falafel/%topping/with/%pairing.txt" {
+		t.Errorf("Unexpected route references: %v", refs)
+	}
+}
+
+func TestSiteBuilderRejectsUnknownTemplateRoutes(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	badPath := path.Join(testWwwRoot, "bad-link.txt")
+	err := ioutil.WriteFile(badPath,
+		[]byte("\f\n\f\n{{urlFor \"/no/such/simplate.txt\"}}\n"), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		MkOutDir:      true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err == nil || !strings.Contains(err.Error(), "/no/such/simplate.txt") {
+		t.Errorf("Site builder did not reject unknown route: %v", err)
+	}
+}
+
+func TestStreamingWriterWritesHeaderOnceAndFlushes(t *testing.T) {
+	site := DeclareWebsite("aspen_test_streaming")
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/stream.txt", nil)
+
+	response := site.NewHTTPResponseWrapper(rec, req)
+	response.SetContentType("text/plain")
+	response.SetStatusCode(http.StatusAccepted)
+
+	fmt.Fprintf(response.Writer(), "first\n")
+	fmt.Fprintf(response.Writer(), "second\n")
+	response.SetError(errors.New("too late"))
+	response.Respond()
+
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("Streamed response has wrong status: %v", rec.Code)
+	}
+
+	if rec.Body.String() != "first\nsecond\n" {
+		t.Errorf("Streamed response has wrong body: %q", rec.Body.String())
+	}
+
+	if !rec.Flushed {
+		t.Errorf("Streamed response was never flushed")
+	}
+}
+
+func TestStreamingServesErrorPageWhenNothingWritten(t *testing.T) {
+	site := DeclareWebsite("aspen_test_streaming_error")
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/stream.txt", nil)
+
+	response := site.NewHTTPResponseWrapper(rec, req)
+	response.Stream()
+	response.SetError(errors.New("boom"))
+	response.Respond()
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Streaming error before write was not a 500: %v", rec.Code)
+	}
+}
+
+func TestStreamingJSONWritesNewlineDelimitedValues(t *testing.T) {
+	site := DeclareWebsite("aspen_test_streaming_ndjson")
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/rows.json", nil)
+
+	response := site.NewHTTPResponseWrapper(rec, req)
+	response.SetContentType("application/x-ndjson")
+	for i := 0; i < 3; i++ {
+		err := response.WriteJSON(map[string]int{"i": i})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	response.RespondJSON()
+
+	if rec.Body.String() != "{\"i\":0}\n{\"i\":1}\n{\"i\":2}\n" {
+		t.Errorf("Unexpected NDJSON body: %q", rec.Body.String())
+	}
+
+	if rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("Unexpected NDJSON content type: %q", rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestDetectsSSESimplates(t *testing.T) {
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/clock.sse", basicSSESimplate)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if s.Type != SimplateTypeSSE {
+		t.Errorf("Simplate detected as %s instead of %s", s.Type, SimplateTypeSSE)
+	}
+
+	var out bytes.Buffer
+	err = s.Execute(&out)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	fset := token.NewFileSet()
+	_, err = parser.ParseFile(fset, s.OutputName(), out.Bytes(), parser.DeclarationErrors)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRejectsRenderedSimplateWithoutTemplatePage(t *testing.T) {
+	_, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/oops.txt", "\f\nctx[\"x\"] = 1\n")
+	if err == nil {
+		t.Errorf("Rendered simplate without template page was not rejected")
+	}
+}
+
+func TestEventStreamSendsEvents(t *testing.T) {
+	site := DeclareWebsite("aspen_test_sse")
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/clock.sse", nil)
+	req.Header.Set("Last-Event-ID", "41")
+
+	response := site.NewHTTPResponseWrapper(rec, req)
+	events := response.EventStream()
+
+	if events.LastEventID() != "41" {
+		t.Errorf("Unexpected last event ID: %q", events.LastEventID())
+	}
+
+	events.SetRetry(1500 * time.Millisecond)
+	events.SendWithID("42", "tick", map[string]int{"n": 1})
+	events.Send("", "two\nlines")
+	events.Close()
+
+	if events.Send("", "late") != ErrEventStreamClosed {
+		t.Errorf("Send after Close did not fail")
+	}
+
+	response.Respond()
+
+	expected := "retry: 1500\n\n" +
+		"id: 42\nevent: tick\ndata: {\"n\":1}\n\n" +
+		"data: two\ndata: lines\n\n"
+	if rec.Body.String() != expected {
+		t.Errorf("Unexpected event stream body: %q", rec.Body.String())
+	}
+
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/event-stream") {
+		t.Errorf("Unexpected event stream content type: %q",
+			rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestDetectsWebSocketSimplates(t *testing.T) {
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/shout.ws", basicWebSocketSimplate)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if s.Type != SimplateTypeWebSocket {
+		t.Errorf("Simplate detected as %s instead of %s", s.Type, SimplateTypeWebSocket)
+	}
+
+	var out bytes.Buffer
+	err = s.Execute(&out)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	fset := token.NewFileSet()
+	_, err = parser.ParseFile(fset, s.OutputName(), out.Bytes(), parser.DeclarationErrors)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWebSocketRejectsNonUpgradeRequests(t *testing.T) {
+	site := DeclareWebsite("aspen_test_ws")
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/shout.ws", nil)
+
+	response := site.NewHTTPResponseWrapper(rec, req)
+	_, err := response.WebSocket()
+	if err == nil {
+		t.Errorf("Plain request was upgraded")
+	}
+
+	response.Respond()
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status for plain request: %v", rec.Code)
+	}
+}
+
+func TestWebSocketEchoesMessagesAndCloses(t *testing.T) {
+	site := DeclareWebsite("aspen_test_ws")
+	closed := make(chan int, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := site.NewHTTPResponseWrapper(w, r)
+		socket, err := response.WebSocket()
+		if err != nil {
+			response.Respond()
+			return
+		}
+
+		socket.OnMessage(func(msg *WebSocketMessage) {
+			socket.SendText(strings.ToUpper(msg.Text()))
+		})
+		socket.OnClose(func(code int, reason string) {
+			closed <- code
+		})
+		socket.Serve()
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET /shout.ws HTTP/1.1\r\nHost: example.org\r\n"+
+		"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", key)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Unexpected handshake status: %v", resp.StatusCode)
+	}
+
+	if resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected Sec-WebSocket-Accept: %q",
+			resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	conn.Write(maskedWebSocketFrame(false, wsOpText, []byte("hel")))
+	conn.Write(maskedWebSocketFrame(true, wsOpPing, []byte("p")))
+	conn.Write(maskedWebSocketFrame(true, wsOpContinuation, []byte("lo")))
+
+	expected := []struct {
+		opcode  byte
+		payload string
+	}{
+		{wsOpPong, "p"},
+		{wsOpText, "HELLO"},
+	}
+
+	for _, e := range expected {
+		opcode, payload := readWebSocketFrame(t, br)
+		if opcode != e.opcode || string(payload) != e.payload {
+			t.Errorf("Expected frame %x %q, got %x %q",
+				e.opcode, e.payload, opcode, payload)
+		}
+	}
+
+	conn.Write(maskedWebSocketFrame(true, wsOpClose, []byte{0x03, 0xe8}))
+
+	opcode, payload := readWebSocketFrame(t, br)
+	if opcode != wsOpClose || !bytes.Equal(payload, []byte{0x03, 0xe8}) {
+		t.Errorf("Unexpected close reply %x %v", opcode, payload)
+	}
+
+	select {
+	case code := <-closed:
+		if code != WebSocketCloseNormal {
+			t.Errorf("Unexpected close code %v", code)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("OnClose was not called")
+	}
+}
+
+func maskedWebSocketFrame(fin bool, opcode byte, payload []byte) []byte {
+	frame := []byte{opcode, 0x80 | byte(len(payload))}
+	if fin {
+		frame[0] |= 0x80
+	}
+
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	return frame
+}
+
+func readWebSocketFrame(t *testing.T, r io.Reader) (byte, []byte) {
+	var hdr [2]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := make([]byte, hdr[1]&0x7f)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hdr[0] & 0x0f, payload
+}
+
+func TestResponseHeadersAndCookiesAreSent(t *testing.T) {
+	site := DeclareWebsite("aspen_test_headers")
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/cart.txt", nil)
+
+	response := site.NewHTTPResponseWrapper(rec, req)
+	rec.Header().Add("Set-Cookie", "visitor=abc; Path=/")
+	response.SetHeader("Cache-Control", "private")
+	response.AddHeader("X-Flavor", "sour")
+	response.AddHeader("X-Flavor", "salty")
+	response.SetCookie(&http.Cookie{Name: "cart", Value: "3", Path: "/"})
+	response.SetCookie(&http.Cookie{Name: "seen", Value: "1", Path: "/"})
+	response.DeleteCookie("cart", "/")
+	response.SetBodyBytes([]byte("ok\n"))
+	response.Respond()
+
+	if rec.Header().Get("Cache-Control") != "private" {
+		t.Errorf("Unexpected Cache-Control: %q", rec.Header().Get("Cache-Control"))
+	}
+
+	if len(rec.Header()["X-Flavor"]) != 2 {
+		t.Errorf("Unexpected X-Flavor: %v", rec.Header()["X-Flavor"])
+	}
+
+	cookies := rec.Header()["Set-Cookie"]
+	if len(cookies) != 3 || cookies[0] != "visitor=abc; Path=/" ||
+		!strings.HasPrefix(cookies[1], "seen=1") || !strings.Contains(cookies[2], "Max-Age=0") {
+		t.Errorf("Unexpected Set-Cookie headers: %v", cookies)
+	}
+}
+
+func TestResponseHeadersAreSentWithErrorPages(t *testing.T) {
+	site := DeclareWebsite("aspen_test_headers")
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/cart.json", nil)
+
+	response := site.NewHTTPResponseWrapper(rec, req)
+	response.SetHeader("Retry-After", "120")
+	response.SetCookie(&http.Cookie{Name: "cart", Value: "3"})
+	response.SetError(errors.New("out of falafel"))
+	response.RespondJSON()
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Unexpected status: %v", rec.Code)
+	}
+
+	if rec.Header().Get("Retry-After") != "120" || rec.Header().Get("Set-Cookie") != "cart=3" {
+		t.Errorf("Headers not sent with error page: %v", rec.Header())
+	}
+}
+
+func TestHTTPErrorGetsItsOwnStatusAndPage(t *testing.T) {
+	site := DeclareWebsite("aspen_test_http_error")
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/falafel/42.txt", nil)
+
+	response := site.NewHTTPResponseWrapper(rec, req)
+	response.SetError(HTTPError{Code: http.StatusGone, Message: "Eaten <all> of it"})
+	response.Respond()
+
+	if rec.Code != http.StatusGone {
+		t.Errorf("Unexpected status: %v", rec.Code)
+	}
+
+	if !strings.Contains(rec.Body.String(), "<p>Eaten &lt;all&gt; of it</p>") {
+		t.Errorf("Message missing from error page: %q", rec.Body.String())
+	}
+}
+
+func TestAbortFinishesResponseWithErrorStatus(t *testing.T) {
+	site := DeclareWebsite("aspen_test_http_error")
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/falafel/42.json", nil)
+
+	response := site.NewHTTPResponseWrapper(rec, req)
+	err := response.Abort(http.StatusNotFound)
+	if e, ok := err.(*HTTPError); !ok || e.Code != http.StatusNotFound {
+		t.Errorf("Unexpected error from Abort: %v", err)
+	}
+
+	if !response.Finished() {
+		t.Errorf("Abort did not finish response")
+	}
+
+	response.RespondJSON()
+
+	if rec.Code != http.StatusNotFound || !bytes.Equal(rec.Body.Bytes(), http404Response) {
+		t.Errorf("Unexpected abort response: %v %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRedirectFinishesResponseWithLocation(t *testing.T) {
+	site := DeclareWebsite("aspen_test_http_error")
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/falafel/old.json", nil)
+
+	response := site.NewHTTPResponseWrapper(rec, req)
+	response.SetBody(map[string]string{"not": "sent"})
+	response.Redirect("/falafel/new.json", http.StatusMovedPermanently)
+	response.RespondJSON()
+
+	if rec.Code != http.StatusMovedPermanently {
+		t.Errorf("Unexpected redirect status: %v", rec.Code)
+	}
+
+	if rec.Header().Get("Location") != "/falafel/new.json" {
+		t.Errorf("Unexpected Location: %q", rec.Header().Get("Location"))
+	}
+
+	if strings.Contains(rec.Body.String(), "sent") {
+		t.Errorf("JSON body sent with redirect: %q", rec.Body.String())
+	}
+}
+
+func TestRedirectDefaultsNonRedirectCodes(t *testing.T) {
+	site := DeclareWebsite("aspen_test_http_error")
+
+	for _, code := range []int{0, http.StatusOK, http.StatusNotFound} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/falafel/old.txt", nil)
+
+		response := site.NewHTTPResponseWrapper(rec, req)
+		response.Redirect("/falafel/new.txt", code)
+		response.Respond()
+
+		if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/falafel/new.txt" {
+			t.Errorf("Redirect with %v sent %v %v", code, rec.Code, rec.Header())
+		}
+	}
+}
+
+func TestAbortAndHTTPErrorsDefaultNonErrorCodes(t *testing.T) {
+	site := DeclareWebsite("aspen_test_http_error")
+
+	for _, code := range []int{0, 42, http.StatusOK, http.StatusFound, 600} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/falafel/42.txt", nil)
+
+		response := site.NewHTTPResponseWrapper(rec, req)
+		err := response.Abort(code)
+		if e, ok := err.(*HTTPError); !ok || e.Code != http.StatusInternalServerError {
+			t.Errorf("Abort(%v) returned %v", code, err)
+		}
+
+		response.Respond()
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("Abort(%v) sent %v", code, rec.Code)
+		}
+
+		rec = httptest.NewRecorder()
+		response = site.NewHTTPResponseWrapper(rec, req)
+		response.SetError(&HTTPError{Code: code, Message: "nope"})
+		response.Respond()
+
+		if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "nope") {
+			t.Errorf("HTTPError with %v sent %v %q", code, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestErrorPagesAreNamedAfterStatusCodes(t *testing.T) {
+	pages := map[string]struct {
+		content  string
+		code     int
+		pageType string
+	}{
+		"/tmp/.aspen/404.spt":        {"\f\n\f\n<h1>{{.status}}</h1>\n", 404, SimplateTypeRendered},
+		"/tmp/.aspen/error.json.spt": {"\f\nresponse.SetBody(ctx)\n", 0, SimplateTypeJson},
+		"/tmp/.aspen/500.spt":        {"\f\n\f text/plain\n{{.code}}\n\f application/json\n{}\n", 500, SimplateTypeNegotiated},
+	}
+
+	for filename, expected := range pages {
+		s, err := newErrorPageFromString("aspen_go_gen", "/tmp", filename, expected.content)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if !s.ErrorPage || s.ErrorCode != expected.code || s.Type != expected.pageType {
+			t.Errorf("Unexpected error page %q: %v %v %v",
+				filename, s.ErrorPage, s.ErrorCode, s.Type)
+		}
+
+		if strings.HasPrefix(s.OutputName(), "-") {
+			t.Errorf("Unexpected output name for %q: %q", filename, s.OutputName())
+		}
+
+		var out bytes.Buffer
+		err = s.Execute(&out)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		fset := token.NewFileSet()
+		_, err = parser.ParseFile(fset, s.OutputName(), out.Bytes(), parser.DeclarationErrors)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, filename := range []string{"/tmp/.aspen/302.spt", "/tmp/.aspen/oops.spt"} {
+		_, err := newErrorPageFromString("aspen_go_gen", "/tmp", filename, "\f\n\f\nx\n")
+		if err == nil {
+			t.Errorf("Error page %q was not rejected", filename)
+		}
+	}
+
+	_, err := newErrorPageFromString("aspen_go_gen", "/tmp", "/tmp/.aspen/404.spt", "Not here\n")
+	if err == nil {
+		t.Errorf("Static error page was not rejected")
+	}
+}
+
+func TestErrorPagesAreServedAndFallBackToCannedPages(t *testing.T) {
+	site := DeclareWebsite("aspen_test_error_pages")
+
+	site.RegisterErrorPage(404, "/.aspen/404.spt", func(w http.ResponseWriter, req *http.Request) {
+		response := site.NewHTTPResponseWrapper(w, req)
+		ctx := map[string]interface{}{}
+		site.PrepareErrorPage(req, response, ctx)
+
+		response.SetContentType("text/plain")
+		response.SetBodyBytes([]byte(fmt.Sprintf("%v %v at %v\n", ctx["code"],
+			ctx["status"], ctx["request"].(*http.Request).URL.Path)))
+		response.Respond()
+	})
+
+	site.RegisterErrorPage(0, "/.aspen/error.spt", func(w http.ResponseWriter, req *http.Request) {
+		response := site.NewHTTPResponseWrapper(w, req)
+		response.SetError(errors.New("error page go boom"))
+		response.Respond()
+	})
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/no/such/falafel", nil)
+	site.serve404(rec, req)
+
+	if rec.Code != http.StatusNotFound || rec.Body.String() != "404 Not Found at /no/such/falafel\n" {
+		t.Errorf("Unexpected custom 404: %v %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	response := site.NewHTTPResponseWrapper(rec, req)
+	response.SetError(errors.New("falafel go boom"))
+	response.Respond()
+
+	if rec.Code != http.StatusInternalServerError || !bytes.Equal(rec.Body.Bytes(), http500Response) {
+		t.Errorf("Failed error page did not fall back to canned page: %v %q",
+			rec.Code, rec.Body.String())
+	}
+}
+
+func TestErrorResponsesAreNegotiated(t *testing.T) {
+	site := DeclareWebsite("aspen_test_negotiated_errors")
+
+	cases := []struct {
+		path        string
+		accept      string
+		contentType string
+	}{
+		{"/falafel/", "text/html,*/*;q=0.8", "text/html; charset=utf-8"},
+		{"/falafel.json", "*/*", "application/problem+json"},
+		{"/falafel.json", "text/html,*/*;q=0.8", "text/html; charset=utf-8"},
+		{"/falafel", "application/json", "application/problem+json"},
+		{"/falafel.txt", "", "text/plain; charset=utf-8"},
+		{"/falafel", "image/png", "text/html; charset=utf-8"},
+	}
+
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", c.path, nil)
+		req.Header.Set("Accept", c.accept)
+		site.ph.updateNegType(req, c.path)
+
+		response := site.NewHTTPResponseWrapper(rec, req)
+		response.SetError(&HTTPError{Code: http.StatusNotFound, Message: "No falafel"})
+		response.Respond()
+
+		if rec.Code != http.StatusNotFound || rec.Header().Get("Content-Type") != c.contentType {
+			t.Errorf("Unexpected error response for %q accepting %q: %v %q",
+				c.path, c.accept, rec.Code, rec.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestJSONSimplateErrorsAreProblemDetails(t *testing.T) {
+	site := DeclareWebsite("aspen_test_negotiated_errors")
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/falafel", nil)
+	req.Header.Set("Accept", "*/*")
+
+	response := site.NewHTTPResponseWrapper(rec, req)
+	response.SetContentType("application/json")
+	response.SetError(errors.New("falafel go boom"))
+	response.RespondJSON()
+
+	problem := map[string]interface{}{}
+	err := json.Unmarshal(rec.Body.Bytes(), &problem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Header().Get("Content-Type") != "application/problem+json" ||
+		problem["status"] != float64(500) || problem["title"] != "Internal Server Error" {
+		t.Errorf("Unexpected problem details: %q %v",
+			rec.Header().Get("Content-Type"), problem)
+	}
+
+	if _, ok := problem["detail"]; ok {
+		t.Errorf("Internal error leaked into problem details: %v", problem)
+	}
+}
+
+func TestRespondJSONDefaultsBodyAndIndentsWhenPretty(t *testing.T) {
+	site := DeclareWebsite("aspen_test_json")
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/falafel.json?pretty", nil)
+
+	response := site.NewHTTPResponseWrapper(rec, req)
+	response.SetContentType("application/json")
+	response.SetStatusCode(http.StatusCreated)
+	response.SetDefaultBody(map[string]int{"n": 1})
+	response.RespondJSON()
+
+	if rec.Code != http.StatusCreated || rec.Body.String() != "{\n  \"n\": 1\n}\n" {
+		t.Errorf("Unexpected JSON response: %v %q", rec.Code, rec.Body.String())
+	}
+
+	if rec.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+		t.Errorf("Unexpected JSON content type: %q", rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestRespondJSONWrapsValidJSONPCallbacks(t *testing.T) {
+	site := DeclareWebsite("aspen_test_json")
+
+	for callback, expected := range map[string]int{
+		"jQuery_123.done": http.StatusOK,
+		"alert(1)//":      http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/falafel.json?cb="+url.QueryEscape(callback), nil)
+
+		response := site.NewHTTPResponseWrapper(rec, req)
+		response.SetContentType("application/json")
+		response.AllowJSONP("cb")
+		response.SetBody([]int{1, 2})
+		response.RespondJSON()
+
+		if rec.Code != expected {
+			t.Errorf("Unexpected status for JSONP callback %q: %v", callback, rec.Code)
+		}
+
+		if expected == http.StatusBadRequest && !strings.Contains(rec.Body.String(), "alert(1)") {
+			t.Errorf("Rejected JSONP callback not reported: %q", rec.Body.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/falafel.json?callback=jQuery_123.done", nil)
+
+	response := site.NewHTTPResponseWrapper(rec, req)
+	response.SetContentType("application/json")
+	response.SetBody([]int{1, 2})
+	response.RespondJSON()
+
+	if rec.Body.String() != "[1,2]" {
+		t.Errorf("JSONP used without opting in: %q", rec.Body.String())
+	}
+}
+
+func TestErrorsKeepErrorStatusSetByLogicPage(t *testing.T) {
+	site := DeclareWebsite("aspen_test_json")
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/falafel.json", nil)
+
+	response := site.NewHTTPResponseWrapper(rec, req)
+	response.SetContentType("application/json")
+	response.SetStatusCode(http.StatusUnprocessableEntity)
+	response.SetError(errors.New("no such topping"))
+	response.RespondJSON()
+
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Unexpected status: %v", rec.Code)
+	}
+}
+
+func TestNegotiatedSimplatesAreServedWithAndWithoutExtension(t *testing.T) {
+	site := DeclareWebsite("aspen_test_negotiated_paths")
+	site.RegisterSimplate(SimplateTypeNegotiated, "/tmp", "/octo",
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("octo"))
+		})
+
+	for requestPath, expected := range map[string]int{
+		"/octo":        http.StatusOK,
+		"/octo.json":   http.StatusOK,
+		"/octopus":     http.StatusNotFound,
+		"/x/octo.json": http.StatusNotFound,
+		"/octo.json/x": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", requestPath, nil)
+		site.ph.ServeHTTP(rec, req)
+
+		if rec.Code != expected {
+			t.Errorf("Unexpected status for %q: %v", requestPath, rec.Code)
+		}
+	}
+}
+
+func TestNegotiationUsesAcceptFormatAndFallback(t *testing.T) {
+	site := DeclareWebsite("aspen_test_negotiation")
+
+	cases := []struct {
+		path     string
+		accept   string
+		fallback string
+		expected string
+		vary     bool
+	}{
+		{"/octo", "application/json", "", "application/json", true},
+		{"/octo", "", "", "text/plain", true},
+		{"/octo?format=json", "text/plain", "", "application/json", false},
+		{"/octo?format=text/plain", "application/json", "", "text/plain", false},
+		{"/octo.json", "text/plain", "", "application/json", false},
+		{"/octo", "image/png", "application/json", "application/json", true},
+		{"/octo", "image/png", "", "", true},
+	}
+
+	for _, c := range cases {
+		site.NegotiationFallback = c.fallback
+
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", c.path, nil)
+		req.Header.Set("Accept", c.accept)
+		req.Header.Set(internalAcceptHeader, "spoofed/type")
+		site.ph.updateNegType(req, req.URL.Path)
+
+		negotiated := ""
+		response := site.NewHTTPResponseWrapper(rec, req)
+		for _, contentType := range []string{"text/plain", "application/json"} {
+			ct := contentType
+			response.RegisterContentTypeHandler(ct, func(*HTTPResponseWrapper) {
+				negotiated = ct
+			})
+		}
+		response.NegotiateAndCallHandler()
+
+		if negotiated != c.expected {
+			t.Errorf("Negotiated %q instead of %q for %q accepting %q",
+				negotiated, c.expected, c.path, c.accept)
+		}
+
+		if (rec.Header().Get("Vary") == "Accept") != c.vary {
+			t.Errorf("Unexpected Vary for %q: %q", c.path, rec.Header().Get("Vary"))
+		}
+	}
+
+	site.NegotiationFallback = ""
+}
+
+func TestNegotiatedIndexServesItsDirectory(t *testing.T) {
+	site := DeclareWebsite("aspen_test_negotiated_index")
+	site.RegisterSimplate(SimplateTypeNegotiated, "/tmp", "/squid/index",
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("negotiated"))
+		})
+	site.RegisterSimplate(SimplateTypeNegotiated, "/tmp", "/clam/index",
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("negotiated"))
+		})
+	site.RegisterSimplate(SimplateTypeRendered, "/tmp", "/clam/index.html",
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("rendered"))
+		})
+
+	for requestPath, expected := range map[string]string{
+		"/squid/":           "negotiated",
+		"/squid/index.json": "negotiated",
+		"/clam/":            "rendered",
+		"/clam/index":       "negotiated",
+	} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", requestPath, nil)
+		site.ph.ServeHTTP(rec, req)
+
+		if rec.Body.String() != expected {
+			t.Errorf("Unexpected response for %q: %v %q", requestPath, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestStaticIndexTakesPrecedenceOverNegotiatedIndex(t *testing.T) {
+	mkTmpDir()
+	defer rmTmpDir()
+
+	os.MkdirAll(path.Join(tmpdir, "oyster"), os.ModeDir|os.ModePerm)
+	ioutil.WriteFile(path.Join(tmpdir, "oyster", "index.html"), []byte("static"), 0644)
+
+	site := DeclareWebsite("aspen_test_negotiated_static_index")
+	site.WwwRoot = tmpdir
+
+	for _, requestPath := range []string{"/oyster/index", "/mussel/index"} {
+		site.RegisterSimplate(SimplateTypeNegotiated, tmpdir, requestPath,
+			func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte("negotiated"))
+			})
+	}
+
+	for requestPath, expected := range map[string]string{
+		"/oyster/":      "static",
+		"/oyster/index": "negotiated",
+		"/mussel/":      "negotiated",
+	} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", requestPath, nil)
+		site.ph.ServeHTTP(rec, req)
+
+		if rec.Body.String() != expected {
+			t.Errorf("Unexpected response for %q: %v %q", requestPath, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestRespondAddsETagAndAnswersIfNoneMatch(t *testing.T) {
+	site := DeclareWebsite("aspen_test_etag")
+
+	respond := func(header, value string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/falafel.txt", nil)
+		if len(header) > 0 {
+			req.Header.Set(header, value)
+		}
+
+		response := site.NewHTTPResponseWrapper(rec, req)
+		response.SetContentType("text/plain")
+		response.SetBodyBytes([]byte("Falafel!\n"))
+		response.Respond()
+		return rec
+	}
+
+	rec := respond("", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || len(etag) == 0 || !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("Unexpected first response: %v %q", rec.Code, etag)
+	}
+
+	rec = respond("If-None-Match", `"nope", W/`+etag)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("Unexpected conditional response: %v %q", rec.Code, rec.Body.String())
+	}
+
+	if rec.Header().Get("ETag") != etag || len(rec.Header().Get("Content-Type")) > 0 {
+		t.Errorf("Unexpected 304 headers: %v", rec.Header())
+	}
+
+	rec = respond("If-None-Match", `"nope"`)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Stale conditional request got %v", rec.Code)
+	}
+}
+
+func TestRespondJSONHonorsExplicitValidators(t *testing.T) {
+	site := DeclareWebsite("aspen_test_etag")
+	modified := time.Date(2013, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for since, expected := range map[time.Time]int{
+		modified:                 http.StatusNotModified,
+		modified.Add(time.Hour):  http.StatusNotModified,
+		modified.Add(-time.Hour): http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/falafel.json", nil)
+		req.Header.Set("If-Modified-Since", since.Format(http.TimeFormat))
+
+		response := site.NewHTTPResponseWrapper(rec, req)
+		response.SetContentType("application/json")
+		response.SetETag("v1")
+		response.SetLastModified(modified)
+		response.SetBody([]string{"falafel"})
+		response.RespondJSON()
+
+		if rec.Code != expected {
+			t.Errorf("Unexpected status for If-Modified-Since %v: %v", since, rec.Code)
+		}
+
+		if rec.Header().Get("ETag") != `"v1"` {
+			t.Errorf("Unexpected ETag: %q", rec.Header().Get("ETag"))
+		}
+	}
+}
+
+func TestNegotiatesContentEncoding(t *testing.T) {
+	for acceptEncoding, expected := range map[string]string{
+		"":                          "",
+		"gzip, deflate":             "gzip",
+		"deflate;q=1, gzip;q=0.5":   "deflate",
+		"*":                         "gzip",
+		"*;q=0.5, gzip;q=0":         "deflate",
+		"identity, br":              "",
+		"GZIP;q=0.8, deflate;q=0.8": "gzip",
+	} {
+		actual := negotiateEncoding(acceptEncoding)
+		if actual != expected {
+			t.Errorf("Accept-Encoding %q negotiated %q, not %q",
+				acceptEncoding, actual, expected)
+		}
+	}
+}
+
+func TestCompressWriterGzipsLargeCompressibleResponses(t *testing.T) {
+	body := strings.Repeat("Pancakes!\n", 500)
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/pancakes.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	cw := newCompressWriter(rec, req)
+	cw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	cw.Header().Set("Content-Length", fmt.Sprintf("%v", len(body)))
+	cw.Header().Set("ETag", `"pancakes"`)
+	io.WriteString(cw, body)
+	cw.Close()
+
+	header := rec.Header()
+	if header.Get("Content-Encoding") != "gzip" || len(header.Get("Content-Length")) > 0 {
+		t.Fatalf("Unexpected compressed headers: %v", header)
+	}
+
+	if header.Get("Vary") != "Accept-Encoding" || header.Get("ETag") != `W/"pancakes"` {
+		t.Errorf("Unexpected Vary or ETag: %v", header)
+	}
+
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unzipped, err := ioutil.ReadAll(gz)
+	if err != nil || string(unzipped) != body {
+		t.Errorf("Unexpected decompressed body (%v): %q", err, unzipped)
+	}
+}
+
+func TestCompressWriterLeavesOtherResponsesAlone(t *testing.T) {
+	big := strings.Repeat("x", DefaultCompressionMinSize)
+
+	for _, tc := range []struct {
+		contentType, contentEncoding, body string
+		expectVary                         bool
+	}{
+		{"text/plain", "", "small", true},
+		{"image/png", "", big, false},
+		{"application/json", "gzip", big, false},
+	} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+
+		cw := newCompressWriter(rec, req)
+		cw.Header().Set("Content-Type", tc.contentType)
+		if len(tc.contentEncoding) > 0 {
+			cw.Header().Set("Content-Encoding", tc.contentEncoding)
+		}
+
+		cw.WriteHeader(http.StatusCreated)
+		io.WriteString(cw, tc.body)
+		cw.Close()
+
+		if rec.Code != http.StatusCreated || rec.Body.String() != tc.body {
+			t.Errorf("%v response was altered: %v %q", tc.contentType, rec.Code, rec.Body.String())
+		}
+
+		if rec.Header().Get("Content-Encoding") != tc.contentEncoding {
+			t.Errorf("%v response got Content-Encoding %q",
+				tc.contentType, rec.Header().Get("Content-Encoding"))
+		}
+
+		if (rec.Header().Get("Vary") == "Accept-Encoding") != tc.expectVary {
+			t.Errorf("%v response got Vary %q", tc.contentType, rec.Header().Get("Vary"))
+		}
+	}
+}
+
+func panicMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Half-Done", "yes")
+		w.Write([]byte("half"))
+		panic("Kaboom!")
+	})
+}
+
+func TestPanicsAreRecoveredWithA500(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	site := DeclareWebsite("aspen_test_panics")
+	site.Use(panicMiddleware)
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/boom.html", nil)
+	site.ph.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError ||
+		!strings.Contains(rec.Body.String(), "500 Internal Server Error") {
+		t.Errorf("Unexpected response to panic: %v %q", rec.Code, rec.Body.String())
+	}
+
+	if len(rec.Header().Get("X-Half-Done")) > 0 || strings.HasPrefix(rec.Body.String(), "half") {
+		t.Errorf("Response from before the panic was sent: %v", rec.Header())
+	}
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/boom.json", nil)
+	site.ph.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError ||
+		rec.Header().Get("Content-Type") != "application/problem+json" {
+		t.Errorf("Unexpected JSON response to panic: %v %v", rec.Code, rec.Header())
+	}
+}
+
+func TestPanickingErrorPageFallsBackToCannedPage(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	site := DeclareWebsite("aspen_test_panicking_error_page")
+	site.RegisterErrorPage(0, "/.aspen/error.spt", func(w http.ResponseWriter, req *http.Request) {
+		panic("Double kaboom!")
+	})
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/boom.html", nil)
+	site.ph.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "404 Not Found") {
+		t.Errorf("Unexpected response from panicking error page: %v %q",
+			rec.Code, rec.Body.String())
+	}
+}
+
+func TestDebugPageShowsErrorHeadersAndContext(t *testing.T) {
+	site := DeclareWebsite("aspen_test_debug_page")
+	site.Debug = true
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/broken.txt", nil)
+	req.Header.Set("X-Flavor", "<garlic>")
+	req.Header.Set(internalSimplateHeader, "/www/broken.txt")
+	req = withDebugInfo(req)
+
+	site.DebugRequestContext(req, map[string]interface{}{"shawarma": 3})
+
+	response := site.NewHTTPResponseWrapper(rec, req)
+	response.SetError(errors.New("Broke the <grill>!"))
+	response.Respond()
+
+	body := rec.Body.String()
+	if rec.Code != http.StatusInternalServerError ||
+		!strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("Unexpected debug page response: %v %v", rec.Code, rec.Header())
+	}
+
+	for _, expected := range []string{
+		"Broke the &lt;grill&gt;!",
+		"*errors.errorString",
+		"/www/broken.txt",
+		"&lt;garlic&gt;",
+		"<th>shawarma</th><td><pre>3</pre>",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Debug page does not contain %q:\n%v", expected, body)
+		}
+	}
+
+	if strings.Contains(body, "X-Aspengo-Simplate") {
+		t.Errorf("Debug page shows internal headers:\n%v", body)
+	}
+
+	site.Debug = false
+	rec = httptest.NewRecorder()
+	response = site.NewHTTPResponseWrapper(rec, req)
+	response.SetError(errors.New("Broke the <grill>!"))
+	response.Respond()
+
+	if strings.Contains(rec.Body.String(), "grill") {
+		t.Errorf("Debug page served when not debugging:\n%v", rec.Body.String())
+	}
+}
+
+func TestSourceExcerptSurroundsTheFailingLine(t *testing.T) {
+	mkTmpDir()
+	defer rmTmpDir()
+
+	filename := path.Join(tmpdir, "excerpt.txt")
+	var lines []string
+	for i := 1; i <= 20; i++ {
+		lines = append(lines, fmt.Sprintf("line %v", i))
+	}
+
+	ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")), 0644)
+
+	excerpt := sourceExcerpt(filename, 18)
+	if len(excerpt) != 8 || excerpt[0].Number != 13 || excerpt[7].Text != "line 20" {
+		t.Fatalf("Unexpected excerpt: %+v", excerpt)
+	}
+
+	if !excerpt[5].Current || excerpt[5].Text != "line 18" || excerpt[4].Current {
+		t.Errorf("Failing line not marked: %+v %+v", excerpt[4], excerpt[5])
+	}
+}
+
+func TestGeneratedSourcesMapLogicPagesToSimplates(t *testing.T) {
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic-rendered.txt", basicRenderedTxtSimplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err = s.Execute(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generated := strings.Split(out.String(), "\n")
+	simplateDirective := fmt.Sprintf("/*line /tmp/basic-rendered.txt:%v*/", s.LogicPage.Line)
+	foundSimplate, foundGenerated := false, false
+
+	for i, line := range generated {
+		if strings.Contains(line, simplateDirective) {
+			foundSimplate = true
+		}
+
+		if strings.Contains(line, fmt.Sprintf("/*line %s:%v*/", s.OutputName(), i+1)) {
+			foundGenerated = true
+		}
+	}
+
+	if !foundSimplate || !foundGenerated {
+		t.Errorf("Missing line directives (%v, %v) in:\n%v",
+			foundSimplate, foundGenerated, out.String())
+	}
+}
+
+func TestContextHoldsStandardRequestData(t *testing.T) {
+	site := DeclareWebsite("aspen_test_request_context")
+
+	req, _ := http.NewRequest("GET", "/falafel/wrap.txt?sauce=tahini", nil)
+	req.Header.Set("User-Agent", "pita")
+	req.Header.Set(internalAcceptHeader, "text/plain; charset=utf-8")
+	req.AddCookie(&http.Cookie{Name: "flavor", Value: "garlic"})
+
+	ctx := map[string]interface{}{}
+	response := site.NewHTTPResponseWrapper(httptest.NewRecorder(), req)
+	site.UpdateContextFromRequest(ctx, req, response)
+
+	if ctx[CtxKeyPath] != "/falafel/wrap.txt" || ctx[CtxKeyMediaType] != "text/plain" ||
+		ctx[CtxKeyRequest] != req || ctx[CtxKeyWebsite] != site {
+		t.Errorf("Unexpected request context: %+v", ctx)
+	}
+
+	if ctx[CtxKeyQuery].(url.Values).Get("sauce") != "tahini" ||
+		ctx[CtxKeyCookies].(map[string]string)["flavor"] != "garlic" {
+		t.Errorf("Unexpected query or cookies in context: %+v", ctx)
+	}
+
+	headers := ctx[CtxKeyHeaders].(http.Header)
+	if headers.Get("User-Agent") != "pita" || len(headers.Get(internalAcceptHeader)) > 0 {
+		t.Errorf("Unexpected headers in context: %v", headers)
+	}
+
+	response.RegisterContentTypeHandler("application/json; charset=utf-8",
+		func(*HTTPResponseWrapper) {})
+	req.Header.Set(internalAcceptHeader, "application/json")
+	response.NegotiateAndCallHandler()
+
+	if ctx[CtxKeyMediaType] != "application/json" {
+		t.Errorf("Negotiation did not update media type in context: %q", ctx[CtxKeyMediaType])
+	}
+}
+
+func TestVirtualPathsMayNotUseReservedContextKeys(t *testing.T) {
+	for _, filename := range []string{"/tmp/menu/%session.txt", "/tmp/%website/menu.txt",
+		"/tmp/menu/%media_type.json"} {
+
+		_, err := newSimplateFromString("aspen_go_gen", "/tmp", filename, basicRenderedTxtSimplate)
+		if err == nil {
+			t.Errorf("Simplate %q with a reserved virtual path was accepted", filename)
+		}
+	}
+
+	_, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/menu/%sessions.txt", basicRenderedTxtSimplate)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGeneratedHandlersFillContextBeforeHooksAndVirtualPaths(t *testing.T) {
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/menu/%item.txt", basicRenderedTxtSimplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err = s.Execute(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := -1
+	for _, call := range []string{"UpdateContextFromRequest(", "LoadSession(",
+		"ParseRequestBody(", "CheckCSRFToken(", "UpdateContextFromVirtualPaths(",
+		"RunInboundHooks("} {
+
+		i := strings.Index(out.String(), call)
+		if i <= last {
+			t.Errorf("%v is called out of order in:\n%v", call, out.String())
+		}
+
+		last = i
+	}
+}
+
+func TestInboundHooksCanFinishJSONSimplatesWithABody(t *testing.T) {
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/menu/orders.json", basicJsonSimplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err = s.Execute(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hooked := out.String()[strings.Index(out.String(), "RunInboundHooks("):]
+	if !strings.HasPrefix(hooked[strings.Index(hooked, "response.Respond"):], "response.RespondJSON()") {
+		t.Errorf("Short-circuited JSON simplate is not sent as JSON:\n%v", out.String())
+	}
+
+	site := DeclareWebsite("aspen_test_hooks_json")
+	site.AddInboundHook(func(request *http.Request,
+		response *HTTPResponseWrapper, ctx map[string]interface{}) error {
+
+		response.SetStatusCode(http.StatusAccepted)
+		response.SetBody(map[string]string{"queued": "yes"})
+		response.Finish()
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/menu/orders.json", nil)
+	response := site.NewHTTPResponseWrapper(rec, req)
+	response.SetContentType("application/json")
+
+	if !site.RunInboundHooks(req, response, map[string]interface{}{}) {
+		t.Fatalf("Inbound hook did not short-circuit")
+	}
+
+	response.RespondJSON()
+	if rec.Code != http.StatusAccepted || strings.TrimSpace(rec.Body.String()) != `{"queued":"yes"}` {
+		t.Errorf("Finished JSON response dropped its body: %v %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestJSONDefaultBodyLeavesOutRequestData(t *testing.T) {
+	site := DeclareWebsite("aspen_test_request_context")
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/falafel.json", nil)
+	req.Header.Set("Authorization", "secret")
+
+	ctx := map[string]interface{}{}
+	response := site.NewHTTPResponseWrapper(rec, req)
+	site.UpdateContextFromRequest(ctx, req, response)
+	ctx["falafel"] = 2
+
+	response.SetDefaultBody(ctx)
+	response.RespondJSON()
+
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"falafel":2}` {
+		t.Errorf("Unexpected JSON body: %v %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestJSONContextBodyLeavesOutRequestData(t *testing.T) {
+	site := DeclareWebsite("aspen_test_request_context")
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/falafel.json", nil)
+
+	ctx := map[string]interface{}{}
+	response := site.NewHTTPResponseWrapper(rec, req)
+	site.UpdateContextFromRequest(ctx, req, response)
+	ctx["falafel"] = 3
+
+	response.SetBody(ctx)
+	response.RespondJSON()
+
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"falafel":3}` {
+		t.Errorf("Unexpected JSON body: %v %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestParseRequestBodyHandlesFormsAndJSON(t *testing.T) {
+	site := DeclareWebsite("aspen_test_request_body")
+
+	req, _ := http.NewRequest("POST", "/order.json",
+		strings.NewReader("filling=falafel&extra=pickles&extra=tahini"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	ctx := map[string]interface{}{}
+	body, err := site.ParseRequestBody(ctx, httptest.NewRecorder(), req)
+	if err != nil || ctx[CtxKeyBody] != body {
+		t.Fatalf("Failed to parse form: %v", err)
+	}
+
+	if body.Get("filling") != "falafel" || len(body.Values("extra")) != 2 ||
+		req.FormValue("filling") != "falafel" {
+		t.Errorf("Unexpected form values: %+v", body.Form)
+	}
+
+	req, _ = http.NewRequest("POST", "/order.json",
+		strings.NewReader(`{"filling": "shawarma", "extra": ["onions", 2], "count": 3}`))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	body, err = site.ParseRequestBody(ctx, httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("Failed to parse JSON: %v", err)
+	}
+
+	if body.Get("filling") != "shawarma" || body.Get("count") != "3" ||
+		strings.Join(body.Values("extra"), ",") != "onions,2" || len(body.Get("nope")) > 0 {
+		t.Errorf("Unexpected JSON values: %+v", body.JSON)
+	}
+
+	req, _ = http.NewRequest("POST", "/order.json", strings.NewReader(`{"filling"`))
+	req.Header.Set("Content-Type", "application/json")
+
+	_, err = site.ParseRequestBody(ctx, httptest.NewRecorder(), req)
+	if e, ok := asHTTPError(err); !ok || e.Code != http.StatusBadRequest {
+		t.Errorf("Malformed JSON got %v", err)
+	}
+}
+
+func TestParseRequestBodyStoresUploadsAndEnforcesMaxSize(t *testing.T) {
+	site := DeclareWebsite("aspen_test_request_body_uploads")
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("filling", "falafel")
+	fw, _ := mw.CreateFormFile("recipe", "recipe.txt")
+	fw.Write(bytes.Repeat([]byte("chickpeas\n"), 1000))
+	mw.Close()
+
+	origMemory := MaxMultipartMemory
+	MaxMultipartMemory = 1024
+	defer func() { MaxMultipartMemory = origMemory }()
+
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	body, err := site.ParseRequestBody(map[string]interface{}{}, httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("Failed to parse multipart body: %v", err)
+	}
+
+	upload := body.File("recipe")
+	if body.Get("filling") != "falafel" || upload == nil || upload.Size != 10000 {
+		t.Fatalf("Unexpected multipart body: %+v %+v", body.Form, upload)
+	}
+
+	f, err := upload.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	osFile, ok := f.(*os.File)
+	f.Close()
+	if !ok {
+		t.Fatalf("Upload was not stored in a temporary file")
+	}
+
+	body.RemoveAll()
+	if _, err := os.Stat(osFile.Name()); !os.IsNotExist(err) {
+		t.Errorf("Temporary file %q was not removed: %v", osFile.Name(), err)
+	}
+
+	site.MaxBodySize = 100
+	for _, contentLength := range []int64{int64(buf.Len()), -1} {
+		req, _ = http.NewRequest("POST", "/upload", bytes.NewReader(buf.Bytes()))
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.ContentLength = contentLength
+
+		rec := httptest.NewRecorder()
+		_, err = site.ParseRequestBody(map[string]interface{}{}, rec, req)
+		if e, ok := asHTTPError(err); !ok || e.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Oversized body with length %v got %v", contentLength, err)
+		}
+
+		if rec.Header().Get("Connection") != "close" {
+			t.Errorf("Oversized body with length %v left the connection open", contentLength)
+		}
+	}
+}
+
+func TestSessionsAreSignedAndKeysRotate(t *testing.T) {
+	sessions := &Sessions{CookieName: "s", Keys: [][]byte{[]byte("old")}, MaxAge: 60}
+	now := time.Now()
+
+	value, err := sessions.sign(`{"n":1}`, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions.Keys = [][]byte{[]byte("new"), []byte("old")}
+	if token, ok := sessions.verify(value, now); !ok || token != `{"n":1}` {
+		t.Errorf("Session signed with rotated key rejected: %q %v", token, ok)
+	}
+
+	if _, ok := sessions.verify(value, now.Add(2*time.Minute)); ok {
+		t.Errorf("Expired session accepted")
+	}
+
+	if _, ok := sessions.verify(value+"x", now); ok {
+		t.Errorf("Tampered session accepted")
+	}
+
+	sessions.Keys = [][]byte{[]byte("new")}
+	if _, ok := sessions.verify(value, now); ok {
+		t.Errorf("Session signed with retired key accepted")
+	}
+}
+
+func TestSessionsRoundTripThroughCookies(t *testing.T) {
+	for _, store := range []SessionStore{nil, NewMemorySessionStore(time.Minute)} {
+		site := DeclareWebsite("aspen_test_sessions")
+		site.EnableSessions([]byte("shh")).Store = store
+
+		var cookies []*http.Cookie
+		request := func() (*HTTPResponseWrapper, *Session, *httptest.ResponseRecorder) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/counter.txt", nil)
+			for _, c := range cookies {
+				req.AddCookie(c)
+			}
+
+			ctx := map[string]interface{}{}
+			response := site.NewHTTPResponseWrapper(rec, req)
+			site.LoadSession(ctx, req, response)
+			return response, ctx[CtxKeySession].(*Session), rec
+		}
+
+		response, session, rec := request()
+		if !session.IsNew() {
+			t.Errorf("First session is not new")
+		}
+
+		session.Set("falafel", "yes")
+		response.Respond()
+
+		cookies = (&http.Response{Header: rec.Header()}).Cookies()
+		if len(cookies) != 1 || cookies[0].Name != DefaultSessionCookieName || !cookies[0].HttpOnly {
+			t.Fatalf("Unexpected session cookies: %v", rec.Header())
+		}
+
+		response, session, rec = request()
+		if session.IsNew() || session.Get("falafel") != "yes" {
+			t.Errorf("Session not loaded (%T): %+v", store, session)
+		}
+
+		response.Respond()
+		if len(rec.Header().Get("Set-Cookie")) > 0 {
+			t.Errorf("Unchanged session was saved: %v", rec.Header())
+		}
+
+		response, session, rec = request()
+		session.Destroy()
+		response.Respond()
+
+		cookies = (&http.Response{Header: rec.Header()}).Cookies()
+		if len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+			t.Errorf("Destroyed session cookie not deleted: %v", rec.Header())
+		}
+	}
+}
+
+// csrfCheckingHandler checks CSRF tokens as generated handlers do, then
+// calls respond.
+func csrfCheckingHandler(site *Website,
+	respond func(*HTTPResponseWrapper, map[string]interface{})) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := map[string]interface{}{}
+		response := site.NewHTTPResponseWrapper(w, req)
+		site.UpdateContextFromRequest(ctx, req, response)
+		site.LoadSession(ctx, req, response)
+
+		body, err := site.ParseRequestBody(ctx, w, req)
+		defer body.RemoveAll()
+		if err == nil {
+			err = site.CheckCSRFToken(req, body)
+		}
+
+		if err != nil {
+			response.SetError(err)
+		} else {
+			respond(response, ctx)
+		}
+
+		response.Respond()
+	}
+}
+
+func TestCSRFProtectsUnsafeRequestsToSimplates(t *testing.T) {
+	mkTmpDir()
+	defer rmTmpDir()
+
+	ioutil.WriteFile(path.Join(tmpdir, "robots.txt"), []byte("static"), 0644)
+
+	site := DeclareWebsite("aspen_test_csrf")
+	site.WwwRoot = tmpdir
+	site.EnableCSRF()
+	site.RegisterSimplate(SimplateTypeRendered, "/tmp", "/order.html",
+		csrfCheckingHandler(site, func(response *HTTPResponseWrapper, ctx map[string]interface{}) {
+			response.SetBodyBytes([]byte(fmt.Sprintf("token=%v", ctx[CtxKeyCSRFToken])))
+		}))
+	site.Mount("/api/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "mounted")
+	}))
+	site.Mount("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "root")
+	}))
+
+	serve := func(method, path string, body io.Reader, prepare func(*http.Request)) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, body)
+		if prepare != nil {
+			prepare(req)
+		}
+
+		site.ph.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("GET", "/order.html", nil, nil)
+	cookies := (&http.Response{Header: rec.Header()}).Cookies()
+	if len(cookies) != 1 || cookies[0].Name != DefaultCSRFCookieName {
+		t.Fatalf("CSRF cookie not issued: %v", rec.Header())
+	}
+
+	token := cookies[0].Value
+	if rec.Body.String() != "token="+token {
+		t.Errorf("CSRF token not in ctx: %q", rec.Body.String())
+	}
+
+	withCookie := func(req *http.Request) {
+		req.AddCookie(cookies[0])
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	rec = serve("POST", "/order.html", strings.NewReader("csrf_token=nope"), withCookie)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("POST with bad CSRF token got %v", rec.Code)
+	}
+
+	rec = serve("POST", "/order.html", strings.NewReader("csrf_token="+token), withCookie)
+	if rec.Code != http.StatusOK || len(rec.Header().Get("Set-Cookie")) > 0 {
+		t.Errorf("POST with CSRF field got %v %v", rec.Code, rec.Header())
+	}
+
+	rec = serve("DELETE", "/order.html", nil, func(req *http.Request) {
+		req.AddCookie(cookies[0])
+		req.Header.Set(DefaultCSRFHeaderName, token)
+	})
+	if rec.Code != http.StatusOK {
+		t.Errorf("DELETE with CSRF header got %v", rec.Code)
+	}
+
+	for reqPath, expected := range map[string]string{
+		"/api/orders":  "mounted",
+		"/legacy/form": "root",
+		"/robots.txt":  "static",
+	} {
+		rec = serve("POST", reqPath, strings.NewReader("{}"), nil)
+		if rec.Code != http.StatusOK || rec.Body.String() != expected {
+			t.Errorf("POST to %q without CSRF token got %v %q", reqPath, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestCSRFCookieSurvivesSessionCookies(t *testing.T) {
+	site := DeclareWebsite("aspen_test_csrf_sessions")
+	site.EnableSessions([]byte("shh"))
+	site.EnableCSRF()
+	site.EnableCSRF()
+	site.RegisterSimplate(SimplateTypeRendered, "/tmp", "/cart.html",
+		csrfCheckingHandler(site, func(response *HTTPResponseWrapper, ctx map[string]interface{}) {
+			ctx[CtxKeySession].(*Session).Set("visited", "yes")
+		}))
+
+	if n := len(site.ph.middlewareHandlers[BeforeStringMatch].r); n != 1 {
+		t.Errorf("Enabling CSRF twice added %v middleware", n)
+	}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/cart.html", nil)
+	site.ph.ServeHTTP(rec, req)
+
+	cookies := (&http.Response{Header: rec.Header()}).Cookies()
+	var token string
+	for _, cookie := range cookies {
+		if cookie.Name == DefaultCSRFCookieName {
+			token = cookie.Value
+		}
+	}
+
+	if len(cookies) != 2 || len(token) == 0 {
+		t.Fatalf("New visitor didn't get both cookies: %v", rec.Header())
+	}
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/cart.html", strings.NewReader("csrf_token="+token))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	site.ph.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("POST with CSRF field and session got %v", rec.Code)
+	}
+}
+
+func TestStaticFilesSupportRangesAndValidators(t *testing.T) {
+	mkTmpDir()
+	defer rmTmpDir()
+
+	ioutil.WriteFile(path.Join(tmpdir, "digits.txt"), []byte("0123456789"), 0644)
+
+	site := DeclareWebsite("aspen_test_static_ranges")
+	site.WwwRoot = tmpdir
+
+	serve := func(header, value string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/digits.txt", nil)
+		if len(header) > 0 {
+			req.Header.Set(header, value)
+		}
+
+		site.ph.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("", "")
+	etag, lastModified := rec.Header().Get("ETag"), rec.Header().Get("Last-Modified")
+	if rec.Code != http.StatusOK || rec.Body.String() != "0123456789" ||
+		!strings.HasSuffix(etag, `-a"`) || len(lastModified) == 0 {
+		t.Fatalf("Unexpected static response: %v %v", rec.Code, rec.Header())
+	}
+
+	rec = serve("Range", "bytes=2-4")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "234" ||
+		rec.Header().Get("Content-Range") != "bytes 2-4/10" {
+		t.Errorf("Unexpected range response: %v %v %q", rec.Code, rec.Header(), rec.Body.String())
+	}
+
+	rec = serve("Range", "bytes=0-0,8-")
+	if rec.Code != http.StatusPartialContent ||
+		!strings.HasPrefix(rec.Header().Get("Content-Type"), "multipart/byteranges") {
+		t.Errorf("Unexpected multi-range response: %v %v", rec.Code, rec.Header())
+	}
+
+	rec = serve("Range", "bytes=20-")
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Unsatisfiable range got %v", rec.Code)
+	}
+
+	for header, value := range map[string]string{
+		"If-None-Match":     etag,
+		"If-Modified-Since": lastModified,
+	} {
+		rec = serve(header, value)
+		if rec.Code != http.StatusNotModified || rec.Body.Len() > 0 {
+			t.Errorf("Conditional request with %v got %v", header, rec.Code)
+		}
+	}
+}
+
+func TestStaticHandlerHidesDotfilesSimplatesAndConfigScripts(t *testing.T) {
+	mkTmpDir()
+	defer rmTmpDir()
+
+	for name, content := range map[string]string{
+		".secret":           "shh",
+		"foo.txt":           "foo",
+		"bar.html":          "\x0cbar",
+		"web-config.go":     "package main",
+		".aspen/hooks/a.go": "a",
+	} {
+		fullPath := path.Join(tmpdir, name)
+		os.MkdirAll(path.Dir(fullPath), os.ModeDir|os.ModePerm)
+		ioutil.WriteFile(fullPath, []byte(content), 0644)
+	}
+
+	ioutil.WriteFile(path.Join(tmpdir, SiteIndexFilename), []byte(`{"simplates": {
+		"/foo.txt": {"type": "static"},
+		"/bar.html": {"type": "rendered"}}}`), 0644)
+
+	defer os.Setenv("ASPEN_GO_CONFIGURATION_SCRIPTS",
+		os.Getenv("ASPEN_GO_CONFIGURATION_SCRIPTS"))
+	os.Setenv("ASPEN_GO_CONFIGURATION_SCRIPTS", path.Join(tmpdir, "web-config.go"))
+
+	site := DeclareWebsite("aspen_test_static_hidden")
+	site.WwwRoot = tmpdir
+	site.ListDirs = true
+
+	serve := func(reqPath string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqPath, nil)
+		site.ph.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, reqPath := range []string{"/.secret", "/bar.html", "/web-config.go",
+		"/.aspen/hooks/a.go", "/.aspen/", "/" + SiteIndexFilename} {
+		if rec := serve(reqPath); rec.Code != http.StatusNotFound {
+			t.Errorf("%q got %v", reqPath, rec.Code)
+		}
+	}
+
+	if rec := serve("/foo.txt"); rec.Code != http.StatusOK || rec.Body.String() != "foo" {
+		t.Errorf("/foo.txt got %v %q", rec.Code, rec.Body.String())
+	}
+
+	listing := serve("/").Body.String()
+	if !strings.Contains(listing, `href="/foo.txt"`) {
+		t.Errorf("Listing is missing foo.txt: %v", listing)
+	}
+
+	for _, name := range []string{".secret", "bar.html", "web-config.go", ".aspen"} {
+		if strings.Contains(listing, name) {
+			t.Errorf("Listing includes %q: %v", name, listing)
+		}
+	}
+}
+
+func TestSimplateSourcesAreHiddenWithoutSiteIndex(t *testing.T) {
+	mkTmpDir()
+	defer rmTmpDir()
+
+	for name, content := range map[string]string{
+		"plain.txt":    "plain",
+		"rendered.txt": "\x0c\x0crendered",
+		"octo":         "\x0c\x0c\x0ctext/plain\x0cocto",
+		"README":       "one\x0cbreak",
+	} {
+		ioutil.WriteFile(path.Join(tmpdir, name), []byte(content), 0644)
+	}
+
+	site := DeclareWebsite("aspen_test_static_hidden_no_index")
+	site.WwwRoot = tmpdir
+
+	serve := func(reqPath string) int {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqPath, nil)
+		site.ph.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for reqPath, code := range map[string]int{
+		"/plain.txt":    http.StatusOK,
+		"/README":       http.StatusOK,
+		"/rendered.txt": http.StatusNotFound,
+		"/octo":         http.StatusNotFound,
+	} {
+		if got := serve(reqPath); got != code {
+			t.Errorf("%q without a site index got %v, expected %v", reqPath, got, code)
+		}
+	}
+
+	if site.indexErr == nil {
+		t.Errorf("Missing site index was not remembered")
+	}
+
+	if check := site.ph.staticHandler.sources[path.Join(tmpdir, "plain.txt")]; check == nil || check.source {
+		t.Errorf("Plain file check was not remembered: %+v", check)
+	}
+
+	plainPath := path.Join(tmpdir, "plain.txt")
+	ioutil.WriteFile(plainPath, []byte("now\x0c\x0crendered"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(plainPath, later, later)
+
+	if got := serve("/plain.txt"); got != http.StatusNotFound {
+		t.Errorf("Changed /plain.txt without a site index got %v", got)
+	}
+}
+
+func TestSiteConfigIsHiddenWhateverThePatterns(t *testing.T) {
+	mkTmpDir()
+	defer rmTmpDir()
+
+	for _, name := range []string{".aspen/hooks/inbound.go", SiteIndexFilename,
+		".well-known/security.txt", "menu.txt.bak"} {
+
+		fullPath := path.Join(tmpdir, name)
+		os.MkdirAll(path.Dir(fullPath), os.ModeDir|os.ModePerm)
+		ioutil.WriteFile(fullPath, []byte("{}"), 0644)
+	}
+
+	site := DeclareWebsite("aspen_test_static_hidden_config")
+	site.WwwRoot = tmpdir
+	site.HiddenPatterns = []string{"*.bak"}
+
+	for reqPath, code := range map[string]int{
+		"/.aspen/hooks/inbound.go":  http.StatusNotFound,
+		"/.aspen/":                  http.StatusNotFound,
+		"/" + SiteIndexFilename:     http.StatusNotFound,
+		"/menu.txt.bak":             http.StatusNotFound,
+		"/.well-known/security.txt": http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqPath, nil)
+		site.ph.ServeHTTP(rec, req)
+
+		if rec.Code != code {
+			t.Errorf("%q got %v, expected %v", reqPath, rec.Code, code)
+		}
+	}
+}
+
+func TestDirectoryListingsAreNegotiatedSortedAndPaginated(t *testing.T) {
+	mkTmpDir()
+	defer rmTmpDir()
+
+	os.MkdirAll(path.Join(tmpdir, "listed", "z"), os.ModeDir|os.ModePerm)
+
+	for name, size := range map[string]int{"a.txt": 3000, "b.txt": 1, "c.txt": 20} {
+		ioutil.WriteFile(path.Join(tmpdir, "listed", name), bytes.Repeat([]byte("x"), size), 0644)
+	}
+
+	site := DeclareWebsite("aspen_test_dir_listings")
+	site.WwwRoot = tmpdir
+	site.ListDirs = true
+	site.DirListingPageSize = 3
+
+	serve := func(reqPath, accept string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqPath, nil)
+		req.Header.Set("Accept", accept)
+		site.ph.ServeHTTP(rec, req)
+		return rec
+	}
+
+	listing := &directoryListing{}
+	rec := serve("/listed/?sort=size&order=desc", "application/json")
+	if err := json.Unmarshal(rec.Body.Bytes(), listing); err != nil {
+		t.Fatalf("Listing is not JSON: %v %q", err, rec.Body.String())
+	}
+
+	var names []string
+	for _, ent := range listing.Entries {
+		names = append(names, ent.Name)
+	}
+
+	if strings.Join(names, ",") != "z,a.txt,c.txt" || listing.Page != 1 ||
+		listing.Pages != 2 || listing.Total != 4 {
+		t.Errorf("Unexpected listing: %v %+v", names, listing)
+	}
+
+	rec = serve("/listed/?sort=size&order=desc&page=2", "text/plain")
+	text := rec.Body.String()
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") ||
+		!strings.Contains(text, "page 2 of 2") || !strings.Contains(text, "b.txt  1 B") ||
+		strings.Contains(text, "a.txt") {
+		t.Errorf("Unexpected text listing: %q", text)
+	}
+
+	html := serve("/listed/?format=html", "application/json").Body.String()
+	if !strings.Contains(html, `href="?order=asc&amp;page=2&amp;sort=name"`) ||
+		!strings.Contains(html, "2.9 KiB") {
+		t.Errorf("Unexpected HTML listing: %v", html)
+	}
+
+	os.MkdirAll(path.Join(tmpdir, ".aspen"), os.ModeDir|os.ModePerm)
+	ioutil.WriteFile(path.Join(tmpdir, DirListingTemplate),
+		[]byte(`{{range .Entries}}{{.Name}} {{end}}`), 0644)
+
+	if body := serve("/listed/?page=2", "text/html").Body.String(); body != "c.txt " {
+		t.Errorf("Override template rendered %q", body)
+	}
+
+	tmpl := site.ph.staticHandler.listingTmpl
+	serve("/listed/?page=2", "text/html")
+	if site.ph.staticHandler.listingTmpl != tmpl {
+		t.Errorf("Unchanged override template was parsed again")
+	}
+
+	tmplPath := path.Join(tmpdir, DirListingTemplate)
+	ioutil.WriteFile(tmplPath, []byte(`{{len .Entries}}`), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(tmplPath, later, later)
+
+	if body := serve("/listed/?page=2", "text/html").Body.String(); body != "1" {
+		t.Errorf("Changed override template rendered %q", body)
+	}
+
+	ioutil.WriteFile(path.Join(tmpdir, "listed", "<img src=x onerror=alert(1)>.txt"), []byte("x"), 0644)
+	ioutil.WriteFile(tmplPath, []byte(`{{range .Entries}}<a href="{{.Href}}">{{.Name}}</a>{{end}}`), 0644)
+	later = later.Add(time.Minute)
+	os.Chtimes(tmplPath, later, later)
+
+	body := serve("/listed/?sort=name&order=asc", "text/html").Body.String()
+	if strings.Contains(body, "<img") || !strings.Contains(body, "&lt;img src=x onerror=alert(1)&gt;.txt") {
+		t.Errorf("Override template did not escape file names: %v", body)
+	}
+}
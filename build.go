@@ -1,8 +1,10 @@
 package aspen
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
@@ -239,11 +241,11 @@ func (me *siteBuilder) writeSources() error {
 		return err
 	}
 
+	written := []*simplate{}
+
 	for simplate := range simplates {
 		if simplate == nil {
-			// assume `walker.Simplates()` assigned error to same address
-			// as one above?
-			return err
+			return me.walker.err
 		}
 
 		debugf("Site builder about to write source for %v simplate %q",
@@ -254,6 +256,22 @@ func (me *siteBuilder) writeSources() error {
 		}
 
 		me.indexSimplate(simplate)
+		written = append(written, simplate)
+	}
+
+	err = me.checkRouteReferences(written)
+	if err != nil {
+		return err
+	}
+
+	err = me.writeHooks()
+	if err != nil {
+		return err
+	}
+
+	err = me.writeErrorPages()
+	if err != nil {
+		return err
 	}
 
 	err = me.dumpSiteIndex()
@@ -269,6 +287,91 @@ func (me *siteBuilder) writeSources() error {
 	return nil
 }
 
+func (me *siteBuilder) writeHooks() error {
+	debugf("Site builder writing hooks")
+
+	for _, kind := range HookKinds {
+		hookPath := path.Join(me.WwwRoot, SiteHooksDirname, kind+".go")
+
+		content, err := ioutil.ReadFile(hookPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				debugf("No %v hook found at %q", kind, hookPath)
+				continue
+			}
+
+			return err
+		}
+
+		hook, err := newSiteHookFromString(me.GenPackage,
+			me.WwwRoot, hookPath, kind, string(content))
+		if err != nil {
+			return err
+		}
+
+		err = me.writeOneHook(hook)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (me *siteBuilder) writeErrorPages() error {
+	debugf("Site builder writing error pages")
+
+	errorPagePaths, err := filepath.Glob(path.Join(me.WwwRoot,
+		SiteConfigDirname, "*"+ErrorPageExt))
+	if err != nil {
+		return err
+	}
+
+	for _, errorPagePath := range errorPagePaths {
+		content, err := ioutil.ReadFile(errorPagePath)
+		if err != nil {
+			return err
+		}
+
+		errorPage, err := newErrorPageFromString(me.GenPackage,
+			me.WwwRoot, errorPagePath, string(content))
+		if err != nil {
+			return err
+		}
+
+		err = me.writeOneSource(errorPage)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (me *siteBuilder) writeOneHook(hook *siteHook) error {
+	outname := path.Join(me.packagePath, hook.OutputName())
+	debugf("Writing source for %v hook %v to %v", hook.Kind,
+		hook.Filename, outname)
+
+	err := os.MkdirAll(me.packagePath, os.ModeDir|(os.FileMode)(0755))
+	if err != nil {
+		return err
+	}
+
+	outf, err := os.Create(outname)
+	if err != nil {
+		return err
+	}
+
+	err = hook.Execute(outf)
+	if err != nil {
+		outf.Close()
+		return err
+	}
+
+	return outf.Close()
+}
+
 func (me *siteBuilder) indexSimplate(simplate *simplate) {
 	me.index.Simplates[fmt.Sprintf("/%v", simplate.Filename)] = &simplateSummary{
 		Type:        simplate.Type,
@@ -276,6 +379,29 @@ func (me *siteBuilder) indexSimplate(simplate *simplate) {
 	}
 }
 
+func (me *siteBuilder) checkRouteReferences(simplates []*simplate) error {
+	debugf("Site builder checking template route references")
+
+	for _, simplate := range simplates {
+		for _, page := range simplate.TemplatePages {
+			refs, err := templateRouteReferences(simplate.Filename, page.Body)
+			if err != nil {
+				return fmt.Errorf("Failed to parse template in %q: %v",
+					simplate.Filename, err)
+			}
+
+			for _, ref := range refs {
+				if _, ok := me.index.lookup(ref); !ok {
+					return fmt.Errorf("Template in %q references unknown route %q",
+						simplate.Filename, ref)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
 func (me *siteBuilder) dumpSiteIndex() error {
 	idxPath := path.Join(me.WwwRoot, SiteIndexFilename)
 
@@ -365,6 +491,25 @@ func (me *siteBuilder) formatSources(sources []string) error {
 		}
 	}
 
+	// formatting moves lines about, so line directives pointing back into
+	// the generated sources need updating
+	for _, source := range sources {
+		content, err := ioutil.ReadFile(source)
+		if err != nil {
+			return err
+		}
+
+		resolved := resolveGeneratedLineDirectives(content, filepath.Base(source))
+		if bytes.Equal(resolved, content) {
+			continue
+		}
+
+		err = ioutil.WriteFile(source, resolved, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"io/ioutil"
 	"text/template"
+	"time"
 )
 
 var (
@@ -69,11 +70,75 @@ body { font-family: monospace; }
   </body>
 </html>
 `)
+	httpErrorTmpl = template.Must(template.New("http-error").Parse(`
+<!DOCTYPE html>
+<html>
+  <head>
+    <title>{{.Code}} {{.Status}}</title>
+    <style type="text/css">
+    ` + aspenCss + `
+    </style>
+  </head>
+  <body>
+    <h1>{{.Code}} {{.Status}}</h1>
+    {{if .Message}}<p>{{.Message | html}}</p>{{end}}
+    ` + aspenServerSig + `
+  </body>
+</html>
+`))
+	debugPageTmpl = template.Must(template.New("debug-page").Parse(`
+<!DOCTYPE html>
+<html>
+  <head>
+    <title>{{.Code}} {{.Status}}: {{.Error | html}}</title>
+    <style type="text/css">
+    ` + aspenCss + `
+      h2 { font-size: 14px; margin-top: 2em; }
+      td, th { padding: 1px 5px; text-align: left; vertical-align: top; }
+      .frame { margin: 0.5em 0; }
+      .frame.simplate .location { font-weight: bold; }
+      .excerpt { background: #f4f4f4; margin: 0.5em 0 0.5em 2em; padding: 0.5em; }
+      .excerpt .current { background: #fdd; }
+    </style>
+  </head>
+  <body>
+    <h1>{{.Code}} {{.Status}}</h1>
+    <p id="error"><strong>{{.ErrorType | html}}</strong>: {{.Error | html}}</p>
+    <p id="request">{{.Method | html}} {{.URL | html}}{{if .Simplate}} served by {{.Simplate | html}}{{end}}</p>
+    {{if .Frames}}
+    <h2>Stack</h2>
+    <div id="stack">
+      {{range .Frames}}
+      <div class="frame{{if .Simplate}} simplate{{end}}">
+        <div class="location">{{.File | html}}:{{.Line}} in {{.Function | html}}</div>
+        {{if .Excerpt}}
+        <pre class="excerpt">{{range .Excerpt}}<span{{if .Current}} class="current"{{end}}>{{printf "%5d" .Number}}  {{.Text | html}}</span>
+{{end}}</pre>
+        {{end}}
+      </div>
+      {{end}}
+    </div>
+    {{end}}
+    <h2>Request Headers</h2>
+    <table id="headers">
+      {{range .Headers}}<tr><th>{{.Key | html}}</th><td>{{.Value | html}}</td></tr>
+      {{end}}
+    </table>
+    <h2>Context</h2>
+    <table id="context">
+      {{range .Context}}<tr><th>{{.Key | html}}</th><td><pre>{{.Value | html}}</pre></td></tr>
+      {{else}}<tr><td>(none)</td></tr>
+      {{end}}
+    </table>
+    ` + aspenServerSig + `
+  </body>
+</html>
+`))
 	directoryListingTmpl = template.Must(template.New("directory-listing").Parse(`
 <!DOCTYPE html>
 <html>
   <head>
-    <title>{{.RequestPath}}</title>
+    <title>{{.RequestPath | html}}</title>
     <style type="text/css">
     ` + aspenCss + `
       #directory_listing { font-size: 12px; }
@@ -83,34 +148,42 @@ body { font-family: monospace; }
       .entry.name { width: 300px; }
       .entry.size { width: 50px; }
       .entry.mtime { width: 300px; }
+      #pages a { margin-right: 10px; }
     </style>
   </head>
   <body>
-    <h1 id="request_path">{{.RequestPath}}</h1>
+    <h1 id="request_path">{{.RequestPath | html}}</h1>
     <hr />
     <table id="directory_listing">
       <thead>
         <tr>
-          <th class="entry name">Name</th>
-          <th class="entry size">Size</th>
-          <th class="entry mtime">Last Modified</th>
+          <th class="entry name"><a href="{{.SortURL "name" | html}}">Name</a></th>
+          <th class="entry size"><a href="{{.SortURL "size" | html}}">Size</a></th>
+          <th class="entry mtime"><a href="{{.SortURL "mtime" | html}}">Last Modified</a></th>
         </tr>
       </thead>
       <tbody>
         <tr>
-          <td class="entry name"><a href="{{.WebParentDir}}">../</a></td>
+          <td class="entry name"><a href="{{.WebParentDir | html}}">../</a></td>
           <td class="entry size">-</td>
           <td class="entry mtime">-</td>
         </tr>
         {{range .Entries}}
         <tr>
-          <td class="entry name"><a href="{{.RequestPath}}">{{.LinkName}}</a></td>
-          <td class="entry size">{{.FileInfo.Size}}B</td>
-          <td class="entry mtime">{{.FileInfo.ModTime.UTC}}B</td>
+          <td class="entry name"><a href="{{.Href | html}}">{{.LinkName | html}}</a></td>
+          <td class="entry size">{{.HumanSize}}</td>
+          <td class="entry mtime">{{.LastModified}}</td>
         </tr>
         {{end}}
       </tbody>
     </table>
+    {{if gt .Pages 1}}
+    <p id="pages">
+      {{with .PrevPageURL}}<a href="{{. | html}}">&larr; previous</a>{{end}}
+      page {{.Page}} of {{.Pages}}
+      {{with .NextPageURL}}<a href="{{. | html}}">next &rarr;</a>{{end}}
+    </p>
+    {{end}}
     ` + aspenServerSig + `
   </body>
 </html>
@@ -130,6 +203,9 @@ XvAiIkfp1wxbpYKPYie6GbgWPFxgXjwPaJ4M0DxQdCObxwB26kF4eApkf4n+uuJ50+21csbuJ91T
 dXasXZyx65XHfg/3I7aJ/wx6s5g2PS+pSwcaJy0AchoTUuoRZFRkABp3EO5vAc3A5kiGkuYlB39H
 vVOV5ZV7b8P/ybbj7IrTy9Ocs2ezHGa6rcK1+f9NABS7zQeZAwAA`
 	faviconIco []byte
+
+	// the modification time of canned responses served as static files
+	cannedModTime = time.Now()
 )
 
 func init() {
@@ -0,0 +1,278 @@
+package aspen
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	// responses smaller than this are sent uncompressed
+	DefaultCompressionMinSize = 1024
+
+	// media types which are compressed; others (images, archives and the
+	// like) are assumed to be compressed already, and event streams are
+	// never compressed so that each event reaches the client as it is sent
+	CompressibleMediaTypes = []string{
+		"application/javascript",
+		"application/json",
+		"application/problem+json",
+		"application/x-ndjson",
+		"application/xhtml+xml",
+		"application/xml",
+		"image/svg+xml",
+		"text/*",
+	}
+)
+
+// compressWriter compresses responses with gzip or deflate as negotiated by
+// the request's Accept-Encoding header.  Writes are buffered until
+// `DefaultCompressionMinSize` bytes have been written (or the response is
+// flushed or closed) so that small responses can be sent as-is.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	statusCode int
+	buf        []byte
+	enc        io.WriteCloser
+	decided    bool
+	hijacked   bool
+}
+
+func newCompressWriter(w http.ResponseWriter, req *http.Request) *compressWriter {
+	return &compressWriter{
+		ResponseWriter: w,
+		encoding:       negotiateEncoding(req.Header.Get("Accept-Encoding")),
+		minSize:        DefaultCompressionMinSize,
+	}
+}
+
+func (me *compressWriter) WriteHeader(statusCode int) {
+	if me.decided {
+		me.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	if me.statusCode == 0 {
+		me.statusCode = statusCode
+	}
+}
+
+func (me *compressWriter) Write(p []byte) (int, error) {
+	if !me.decided {
+		me.buf = append(me.buf, p...)
+		if len(me.buf) < me.minSize {
+			return len(p), nil
+		}
+
+		me.decide()
+		return len(p), me.writeBuffered()
+	}
+
+	if me.enc != nil {
+		return me.enc.Write(p)
+	}
+
+	return me.ResponseWriter.Write(p)
+}
+
+func (me *compressWriter) Flush() {
+	if !me.decided {
+		me.decide()
+		me.writeBuffered()
+	}
+
+	if f, ok := me.enc.(interface {
+		Flush() error
+	}); ok {
+		f.Flush()
+	}
+
+	if f, ok := me.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (me *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := me.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Response does not support hijacking")
+	}
+
+	me.hijacked = true
+	return hj.Hijack()
+}
+
+// Close writes anything still buffered and finishes the compressed stream.
+func (me *compressWriter) Close() error {
+	if me.hijacked {
+		return nil
+	}
+
+	if !me.decided {
+		me.decide()
+		err := me.writeBuffered()
+		if err != nil {
+			return err
+		}
+	}
+
+	if me.enc != nil {
+		return me.enc.Close()
+	}
+
+	return nil
+}
+
+// reset discards the status, headers and anything buffered so far, returning
+// false if the response has already been started.
+func (me *compressWriter) reset() bool {
+	if me.decided || me.hijacked {
+		return false
+	}
+
+	me.statusCode = 0
+	me.buf = nil
+
+	header := me.Header()
+	for key := range header {
+		delete(header, key)
+	}
+
+	return true
+}
+
+func (me *compressWriter) decide() {
+	me.decided = true
+
+	if me.statusCode == 0 {
+		me.statusCode = http.StatusOK
+	}
+
+	header := me.Header()
+
+	if me.compressible() {
+		header.Add("Vary", "Accept-Encoding")
+
+		if len(me.encoding) > 0 && len(me.buf) >= me.minSize {
+			debugf("Compressing response with %v", me.encoding)
+			header.Set("Content-Encoding", me.encoding)
+			header.Del("Content-Length")
+
+			// the compressed representation is not byte-for-byte the same
+			if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+				header.Set("ETag", "W/"+etag)
+			}
+
+			if me.encoding == "gzip" {
+				me.enc = gzip.NewWriter(me.ResponseWriter)
+			} else {
+				me.enc = zlib.NewWriter(me.ResponseWriter)
+			}
+		}
+	}
+
+	me.ResponseWriter.WriteHeader(me.statusCode)
+}
+
+func (me *compressWriter) writeBuffered() error {
+	buf := me.buf
+	me.buf = nil
+
+	if len(buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if me.enc != nil {
+		_, err = me.enc.Write(buf)
+	} else {
+		_, err = me.ResponseWriter.Write(buf)
+	}
+
+	return err
+}
+
+func (me *compressWriter) compressible() bool {
+	switch {
+	case me.statusCode < http.StatusOK,
+		me.statusCode == http.StatusNoContent,
+		me.statusCode == http.StatusPartialContent,
+		me.statusCode == http.StatusNotModified:
+		return false
+	}
+
+	header := me.Header()
+	if len(header.Get("Content-Encoding")) > 0 || len(header.Get("Content-Range")) > 0 {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType == "text/event-stream" {
+		return false
+	}
+
+	for _, compressible := range CompressibleMediaTypes {
+		if compressible == mediaType ||
+			(strings.HasSuffix(compressible, "/*") &&
+				strings.HasPrefix(mediaType, strings.TrimSuffix(compressible, "*"))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip, or returns "" if neither is acceptable.
+func negotiateEncoding(acceptEncoding string) string {
+	qvalues := map[string]float64{}
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					parsed = 0
+				}
+
+				q = parsed
+			}
+		}
+
+		qvalues[coding] = q
+	}
+
+	qvalue := func(coding string) float64 {
+		if q, ok := qvalues[coding]; ok {
+			return q
+		}
+
+		return qvalues["*"]
+	}
+
+	gzipQ, deflateQ := qvalue("gzip"), qvalue("deflate")
+
+	switch {
+	case gzipQ > 0 && gzipQ >= deflateQ:
+		return "gzip"
+	case deflateQ > 0:
+		return "deflate"
+	}
+
+	return ""
+}
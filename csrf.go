@@ -0,0 +1,157 @@
+package aspen
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultCSRFCookieName = "csrf_token"
+	DefaultCSRFFieldName  = "csrf_token"
+	DefaultCSRFHeaderName = "X-CSRF-Token"
+
+	csrfTokenLength = 32
+)
+
+type csrfContextKey struct{}
+
+// CSRF configures protection against cross-site request forgery.  Each
+// client is issued a random token in a cookie, which is also in `ctx` under
+// "csrf_token" for inclusion in forms.  Requests to simplates using methods
+// other than GET, HEAD, OPTIONS and TRACE must send it back in the form field
+// or header named here, or get a 403.
+type CSRF struct {
+	CookieName string
+	FieldName  string
+	HeaderName string
+
+	Path     string
+	Domain   string
+	MaxAge   int
+	Secure   bool
+	SameSite http.SameSite
+}
+
+// EnableCSRF turns on CSRF protection, returning its configuration for
+// further changes.  The middleware issuing tokens runs after any added with
+// `Use` before EnableCSRF is called, and before any added afterwards.  It is
+// only added once, however many times EnableCSRF is called.
+func (me *Website) EnableCSRF() *CSRF {
+	me.CSRF = &CSRF{
+		CookieName: DefaultCSRFCookieName,
+		FieldName:  DefaultCSRFFieldName,
+		HeaderName: DefaultCSRFHeaderName,
+		Path:       "/",
+		MaxAge:     int((365 * 24 * time.Hour).Seconds()),
+		SameSite:   http.SameSiteLaxMode,
+	}
+
+	// configuration scripts enable CSRF on websites without a pipeline; the
+	// middleware is added when a website is declared from their config.
+	if me.ph != nil {
+		me.useCSRF()
+	}
+
+	return me.CSRF
+}
+
+func (me *Website) useCSRF() {
+	if me.usingCSRF {
+		return
+	}
+
+	me.usingCSRF = true
+	me.Use(me.csrfMiddleware)
+}
+
+func (me *Website) csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		csrf := me.CSRF
+
+		var token string
+		if cookie, err := req.Cookie(csrf.CookieName); err == nil && validCSRFToken(cookie.Value) {
+			token = cookie.Value
+		} else {
+			token = newCSRFToken()
+			setCookie(w.Header(), csrf.cookie(token))
+		}
+
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(),
+			csrfContextKey{}, token)))
+	})
+}
+
+// CheckCSRFToken is called by generated handlers once the request body has
+// been parsed.  If CSRF protection is enabled, requests using unsafe methods
+// that don't send the client's token back in a header or form field get an
+// HTTPError with a 403.
+func (me *Website) CheckCSRFToken(req *http.Request, body *RequestBody) error {
+	token, ok := csrfTokenFromRequest(req)
+	if me.CSRF == nil || !ok || csrfSafeMethod(req.Method) {
+		return nil
+	}
+
+	sent := req.Header.Get(me.CSRF.HeaderName)
+	if len(sent) == 0 && body != nil {
+		sent = body.Form.Get(me.CSRF.FieldName)
+	}
+
+	if csrfTokensEqual(sent, token) {
+		return nil
+	}
+
+	debugf("Rejecting %v %q with bad CSRF token", req.Method, req.URL.Path)
+	return &HTTPError{
+		Code:    http.StatusForbidden,
+		Message: "Missing or invalid CSRF token.",
+	}
+}
+
+func (me *CSRF) cookie(token string) *http.Cookie {
+	return &http.Cookie{
+		Name:     me.CookieName,
+		Value:    token,
+		Path:     me.Path,
+		Domain:   me.Domain,
+		MaxAge:   me.MaxAge,
+		Secure:   me.Secure,
+		SameSite: me.SameSite,
+	}
+}
+
+func csrfTokenFromRequest(req *http.Request) (string, bool) {
+	token, ok := req.Context().Value(csrfContextKey{}).(string)
+	return token, ok
+}
+
+func csrfSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+
+	return false
+}
+
+func csrfTokensEqual(a, b string) bool {
+	return len(a) > 0 && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func newCSRFToken() string {
+	random := make([]byte, csrfTokenLength)
+	_, err := rand.Read(random)
+	if err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(random)
+}
+
+func validCSRFToken(token string) bool {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	return err == nil && len(decoded) == csrfTokenLength
+}
@@ -0,0 +1,208 @@
+package aspen
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// lines of source shown either side of the failing line
+const debugExcerptContext = 5
+
+type debugContextKey struct{}
+
+// requestDebugInfo collects what the debug page shows about a request as it
+// is handled.  It's only attached to requests when Website.Debug is on.
+type requestDebugInfo struct {
+	ctx map[string]interface{}
+}
+
+type debugPage struct {
+	Code      int
+	Status    string
+	Error     string
+	ErrorType string
+	Method    string
+	URL       string
+	Simplate  string
+	Frames    []*debugFrame
+	Headers   []*debugPair
+	Context   []*debugPair
+}
+
+type debugFrame struct {
+	Function string
+	File     string
+	Line     int
+	Simplate bool
+	Excerpt  []*debugSourceLine
+}
+
+type debugSourceLine struct {
+	Number  int
+	Text    string
+	Current bool
+}
+
+type debugPair struct {
+	Key   string
+	Value string
+}
+
+func withDebugInfo(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(),
+		debugContextKey{}, &requestDebugInfo{}))
+}
+
+func debugInfoFromRequest(req *http.Request) *requestDebugInfo {
+	info, _ := req.Context().Value(debugContextKey{}).(*requestDebugInfo)
+	return info
+}
+
+// DebugRequestContext is called by generated handlers with the `ctx` they
+// pass to the logic page, so that the debug page can show it should the
+// request fail.
+func (me *Website) DebugRequestContext(req *http.Request, ctx map[string]interface{}) {
+	if errorPageFromRequest(req) != nil {
+		return
+	}
+
+	if info := debugInfoFromRequest(req); info != nil {
+		info.ctx = ctx
+	}
+}
+
+// respondDebugPage writes an HTML page describing err, with its stack (if it
+// was a panic) mapped onto simplates, the request headers and `ctx`.
+func (me *HTTPResponseWrapper) respondDebugPage(code int, err error) bool {
+	page := &debugPage{
+		Code:      code,
+		Status:    http.StatusText(code),
+		Error:     fmt.Sprintf("%v", err),
+		ErrorType: fmt.Sprintf("%T", err),
+		Method:    me.req.Method,
+		URL:       me.req.URL.String(),
+		Simplate:  me.req.Header.Get(internalSimplateHeader),
+	}
+
+	if pe, ok := err.(*panicError); ok {
+		page.Error = fmt.Sprintf("%v", pe.value)
+		page.ErrorType = fmt.Sprintf("panic (%T)", pe.value)
+		page.Frames = me.website.debugFrames(pe.pcs)
+	}
+
+	for key, values := range me.req.Header {
+		if strings.HasPrefix(strings.ToLower(key), "x-aspengo-") {
+			continue
+		}
+
+		page.Headers = append(page.Headers,
+			&debugPair{Key: key, Value: strings.Join(values, ", ")})
+	}
+
+	sort.Slice(page.Headers, func(i, j int) bool {
+		return page.Headers[i].Key < page.Headers[j].Key
+	})
+
+	if info := debugInfoFromRequest(me.req); info != nil {
+		for key, value := range info.ctx {
+			if key == CtxKeyRequest || key == CtxKeyWebsite {
+				continue
+			}
+
+			page.Context = append(page.Context,
+				&debugPair{Key: key, Value: fmt.Sprintf("%+v", value)})
+		}
+
+		sort.Slice(page.Context, func(i, j int) bool {
+			return page.Context[i].Key < page.Context[j].Key
+		})
+	}
+
+	var buf bytes.Buffer
+
+	tmplErr := debugPageTmpl.Execute(&buf, page)
+	if tmplErr != nil {
+		debugf("Failed to render debug page for %q: %v", me.req.URL.Path, tmplErr)
+		return false
+	}
+
+	me.w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	me.w.Header().Set("Cache-Control", "no-store")
+	me.w.WriteHeader(code)
+	me.w.Write(buf.Bytes())
+	return true
+}
+
+// debugFrames resolves a panic's stack, starting at the code that panicked,
+// and adds source excerpts to the frames that are in simplates.
+func (me *Website) debugFrames(pcs []uintptr) []*debugFrame {
+	wwwRoot, err := filepath.Abs(me.WwwRoot)
+	if err != nil {
+		wwwRoot = me.WwwRoot
+	}
+
+	var frames []*debugFrame
+
+	callers := runtime.CallersFrames(pcs)
+	for {
+		frame, more := callers.Next()
+
+		if len(frames) > 0 || !strings.HasPrefix(frame.Function, "runtime.") {
+			df := &debugFrame{
+				Function: frame.Function,
+				File:     frame.File,
+				Line:     frame.Line,
+				Simplate: strings.HasPrefix(frame.File, wwwRoot+string(filepath.Separator)),
+			}
+
+			if df.Simplate {
+				df.Excerpt = sourceExcerpt(frame.File, frame.Line)
+			}
+
+			frames = append(frames, df)
+		}
+
+		if !more {
+			break
+		}
+	}
+
+	return frames
+}
+
+func sourceExcerpt(filename string, line int) []*debugSourceLine {
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+
+	lines := strings.Split(string(source), "\n")
+
+	first := line - debugExcerptContext
+	if first < 1 {
+		first = 1
+	}
+
+	last := line + debugExcerptContext
+	if last > len(lines) {
+		last = len(lines)
+	}
+
+	var excerpt []*debugSourceLine
+	for n := first; n <= last; n++ {
+		excerpt = append(excerpt, &debugSourceLine{
+			Number:  n,
+			Text:    strings.Replace(lines[n-1], "\x0c", "^L", -1),
+			Current: n == line,
+		})
+	}
+
+	return excerpt
+}
@@ -0,0 +1,431 @@
+package aspen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"bitbucket.org/ww/goautoneg"
+)
+
+var (
+	DefaultDirListingPageSize = 500
+	// path within the document root of an html/template overriding the HTML
+	// directory listing
+	DirListingTemplate = ".aspen/directory-listing.html"
+	SortQueryParam     = "sort"
+	OrderQueryParam    = "order"
+	PageQueryParam     = "page"
+
+	dirListingMediaTypes = []string{"text/html", "application/json", "text/plain"}
+	dirListingSortKeys   = []string{"name", "size", "mtime"}
+)
+
+type directoryListing struct {
+	RequestPath string                   `json:"path"`
+	FullPath    string                   `json:"-"`
+	Entries     []*directoryListingEntry `json:"entries"`
+	Sort        string                   `json:"sort"`
+	Order       string                   `json:"order"`
+	Page        int                      `json:"page"`
+	Pages       int                      `json:"pages"`
+	Total       int                      `json:"total"`
+}
+
+type directoryListingEntry struct {
+	Name        string      `json:"name"`
+	RequestPath string      `json:"path"`
+	IsDir       bool        `json:"is_dir"`
+	Size        int64       `json:"size"`
+	ModTime     time.Time   `json:"mtime"`
+	LinkName    string      `json:"-"`
+	FileInfo    os.FileInfo `json:"-"`
+}
+
+func (me *websiteStaticHandler) serveDirListing(w http.ResponseWriter,
+	req *http.Request) error {
+
+	debugf("Serving directory listing for %q", req.URL.Path)
+
+	fullPath := req.Header.Get(pathTransHeader)
+	if len(fullPath) == 0 {
+		fullPath = path.Join(me.w.WwwRoot, strings.TrimLeft(req.URL.Path, "/"))
+	}
+
+	fi, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("%q is not a directory!", fullPath)
+	}
+
+	if me.hidden(fullPath) {
+		debugf("Refusing to list hidden directory %q", fullPath)
+		return os.ErrNotExist
+	}
+
+	dirListing, err := newDirListing(req.URL.Path, fullPath, me.hidden)
+	if err != nil {
+		return err
+	}
+
+	query := req.URL.Query()
+	dirListing.sort(query.Get(SortQueryParam), query.Get(OrderQueryParam))
+	dirListing.paginate(query.Get(PageQueryParam), me.w.DirListingPageSize)
+
+	var (
+		body      []byte
+		mediaType = negotiateDirListingMediaType(w, req)
+	)
+
+	switch mediaType {
+	case "application/json":
+		body, err = dirListing.Json(me.w.Debug)
+	case "text/plain":
+		body, err = dirListing.Text()
+	default:
+		body, err = dirListing.Html(me.dirListingTemplate())
+	}
+
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Length", fmt.Sprintf("%v", len(body)))
+	w.Header().Set("Content-Type",
+		fmt.Sprintf("%v; charset=%v", mediaType, me.w.CharsetDynamic))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+
+	return nil
+}
+
+// listingTemplate is satisfied by the canned listing, a text/template which
+// escapes its output itself, and by overrides, which are html/templates.
+type listingTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// dirListingTemplate returns the site's override of the HTML directory
+// listing, if it has one, or the canned template.  Overrides are parsed with
+// html/template, so names are escaped for where they're used, and only
+// parsed again when their modification time changes.
+func (me *websiteStaticHandler) dirListingTemplate() listingTemplate {
+	tmplPath := path.Join(me.w.WwwRoot, DirListingTemplate)
+
+	info, err := os.Stat(tmplPath)
+	if err != nil {
+		return directoryListingTmpl
+	}
+
+	me.l.Lock()
+	defer me.l.Unlock()
+
+	if me.listingTmpl != nil && info.ModTime().Equal(me.listingTmplModTime) {
+		return me.listingTmpl
+	}
+
+	me.listingTmpl = directoryListingTmpl
+	me.listingTmplModTime = info.ModTime()
+
+	raw, err := ioutil.ReadFile(tmplPath)
+	if err != nil {
+		return directoryListingTmpl
+	}
+
+	tmpl, err := template.New(DirListingTemplate).Parse(string(raw))
+	if err != nil {
+		log.Printf("aspen: using the canned directory listing as %q is invalid: %v",
+			tmplPath, err)
+		return directoryListingTmpl
+	}
+
+	me.listingTmpl = tmpl
+	return tmpl
+}
+
+// negotiateDirListingMediaType negotiates the listing's media type from the
+// Accept header, unless overridden by a `format` query parameter, falling
+// back to HTML.
+func negotiateDirListingMediaType(w http.ResponseWriter, req *http.Request) string {
+	accept := req.Header.Get(internalAcceptHeader)
+	if len(accept) == 0 {
+		w.Header().Add("Vary", "Accept")
+
+		accept = req.Header.Get("Accept")
+		if len(accept) == 0 {
+			accept = "*/*"
+		}
+	}
+
+	negotiated := goautoneg.Negotiate(accept, dirListingMediaTypes)
+	if len(negotiated) == 0 {
+		negotiated = dirListingMediaTypes[0]
+	}
+
+	return negotiated
+}
+
+func newDirListing(requestPath, dirPath string,
+	hidden func(string) bool) (*directoryListing, error) {
+
+	entries, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	dlEntries := []*directoryListingEntry{}
+
+	for _, ent := range entries {
+		if hidden(path.Join(dirPath, ent.Name())) {
+			continue
+		}
+
+		reqPath := path.Join(requestPath, ent.Name())
+		linkName := ent.Name()
+
+		if ent.IsDir() {
+			reqPath = reqPath + "/"
+			linkName = linkName + "/"
+		}
+
+		dlEnt := &directoryListingEntry{
+			Name:        ent.Name(),
+			RequestPath: reqPath,
+			IsDir:       ent.IsDir(),
+			Size:        ent.Size(),
+			ModTime:     ent.ModTime().UTC(),
+			LinkName:    linkName,
+			FileInfo:    ent,
+		}
+
+		dlEntries = append(dlEntries, dlEnt)
+	}
+
+	dl := &directoryListing{
+		RequestPath: requestPath,
+		FullPath:    dirPath,
+		Entries:     dlEntries,
+		Sort:        dirListingSortKeys[0],
+		Order:       "asc",
+		Page:        1,
+		Pages:       1,
+		Total:       len(dlEntries),
+	}
+	return dl, nil
+}
+
+// sort orders the entries by name, size or mtime, ascending or descending,
+// always listing directories first.  Unknown keys and orders are ignored.
+func (me *directoryListing) sort(key, order string) {
+	for _, sortKey := range dirListingSortKeys {
+		if key == sortKey {
+			me.Sort = key
+		}
+	}
+
+	if order == "desc" {
+		me.Order = order
+	}
+
+	less := func(a, b *directoryListingEntry) bool {
+		switch me.Sort {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "mtime":
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		}
+
+		return a.Name < b.Name
+	}
+
+	sort.SliceStable(me.Entries, func(i, j int) bool {
+		a, b := me.Entries[i], me.Entries[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+
+		if me.Order == "desc" {
+			return less(b, a)
+		}
+
+		return less(a, b)
+	})
+}
+
+// paginate keeps only the requested page of entries, clamped to those
+// available.  A page size of 0 or less lists every entry.
+func (me *directoryListing) paginate(page string, pageSize int) {
+	if pageSize <= 0 || len(me.Entries) <= pageSize {
+		return
+	}
+
+	me.Pages = (len(me.Entries) + pageSize - 1) / pageSize
+
+	me.Page, _ = strconv.Atoi(page)
+	if me.Page < 1 {
+		me.Page = 1
+	} else if me.Page > me.Pages {
+		me.Page = me.Pages
+	}
+
+	start := (me.Page - 1) * pageSize
+	end := start + pageSize
+	if end > len(me.Entries) {
+		end = len(me.Entries)
+	}
+
+	me.Entries = me.Entries[start:end]
+}
+
+func (me *directoryListing) Html(tmpl listingTemplate) ([]byte, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, me)
+	if err != nil {
+		return []byte(""), err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (me *directoryListing) Json(indent bool) ([]byte, error) {
+	if !indent {
+		return json.Marshal(me)
+	}
+
+	body, err := json.MarshalIndent(me, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(body, '\n'), nil
+}
+
+func (me *directoryListing) Text() ([]byte, error) {
+	var buf bytes.Buffer
+
+	fmt.Fprintln(&buf, me.RequestPath)
+	if me.Pages > 1 {
+		fmt.Fprintf(&buf, "page %v of %v\n", me.Page, me.Pages)
+	}
+
+	fmt.Fprintln(&buf)
+
+	tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	for _, ent := range me.Entries {
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", ent.LinkName, ent.HumanSize(),
+			ent.LastModified())
+	}
+
+	err := tw.Flush()
+	if err != nil {
+		return []byte(""), err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (me *directoryListing) WebParentDir() string {
+	if me.RequestPath == "/" {
+		return "/"
+	}
+
+	parDir := path.Dir(strings.TrimRight(me.RequestPath, "/"))
+
+	if parDir == "/" {
+		return "/"
+	}
+
+	return (&url.URL{Path: parDir + "/"}).String()
+}
+
+// SortURL links to the listing sorted by key, reversing the order if it is
+// already sorted that way.
+func (me *directoryListing) SortURL(key string) string {
+	order := "asc"
+	if key == me.Sort && me.Order == "asc" {
+		order = "desc"
+	}
+
+	return me.queryURL(key, order, 1)
+}
+
+// PageURL links to a page of the listing, or is empty if there is no such
+// page.
+func (me *directoryListing) PageURL(page int) string {
+	if page < 1 || page > me.Pages {
+		return ""
+	}
+
+	return me.queryURL(me.Sort, me.Order, page)
+}
+
+func (me *directoryListing) PrevPageURL() string {
+	return me.PageURL(me.Page - 1)
+}
+
+func (me *directoryListing) NextPageURL() string {
+	return me.PageURL(me.Page + 1)
+}
+
+func (me *directoryListing) queryURL(key, order string, page int) string {
+	query := url.Values{}
+	query.Set(SortQueryParam, key)
+	query.Set(OrderQueryParam, order)
+	if page > 1 {
+		query.Set(PageQueryParam, strconv.Itoa(page))
+	}
+
+	return "?" + query.Encode()
+}
+
+// Href is the entry's request path escaped for use in a link.
+func (me *directoryListingEntry) Href() string {
+	return (&url.URL{Path: me.RequestPath}).String()
+}
+
+// HumanSize is the entry's size in bytes or binary multiples of them, or "-"
+// for directories.
+func (me *directoryListingEntry) HumanSize() string {
+	if me.IsDir {
+		return "-"
+	}
+
+	return humanSize(me.Size)
+}
+
+func (me *directoryListingEntry) LastModified() string {
+	return me.ModTime.Format("2006-01-02 15:04:05 MST")
+}
+
+func humanSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%v B", size)
+	}
+
+	value, units := float64(size)/1024, "KMGTPE"
+	for value >= 1024 && len(units) > 1 {
+		value, units = value/1024, units[1:]
+	}
+
+	return fmt.Sprintf("%.1f %ciB", value, units[0])
+}
@@ -4,5 +4,111 @@ Go port of the Aspen web framework (http://aspen.io).
 aspen currently supports rendered, negotiated, and static Simplates as
 described here: http://aspen.io/simplates/. The only template engine
 implemented is Go's standard library "text/template".
+
+Negotiated simplates are served at their own path, negotiated from the Accept
+header (or a `format` query parameter such as ?format=json), and at their path
+plus the extension of one of their media types.  Website.NegotiationFallback
+names a media type to serve instead of a 406 when nothing is acceptable.
+A negotiated simplate named after an index without its extension (e.g.
+octo/index) serves its directory, unless a rendered or static index does.
+
+Before the logic page runs, `ctx` holds the request's "path", "query"
+(url.Values), "headers" (http.Header), "cookies" (names to values),
+"media_type" (set once negotiated, for negotiated simplates), "request" and
+"website"; see the CtxKey constants.  These, "body" and "session" (below) are
+set before inbound hooks run.  The names are reserved, and the build fails
+for simplates with virtual paths of the same name (e.g. %session).
+
+Form, multipart and JSON request bodies are parsed into "body" (an
+*aspen.RequestBody), with uploads beyond MaxMultipartMemory streamed to
+temporary files that are removed after the request.  Bodies larger than
+Website.MaxBodySize get a 413 and malformed ones a 400.
+
+Sessions are enabled with Website.EnableSessions and found in `ctx` under
+"session" (an *aspen.Session).  By default their values are kept, signed but
+not encrypted, in a cookie; a MemorySessionStore or any other SessionStore may
+be used instead, with only a signed token in the cookie.  Changed sessions are
+saved just before the response's headers are written, so WebSockets may read
+but not change them.
+
+CSRF protection is enabled with Website.EnableCSRF.  Clients are issued a
+token in a cookie, and forms should include it (from `ctx` under "csrf_token")
+in a "csrf_token" field; scripts may send it in an X-CSRF-Token header.
+POST, PUT, PATCH and DELETE requests (and any others but GET, HEAD, OPTIONS
+and TRACE) to simplates without it get a 403; static files and mounted
+handlers are left alone.
+
+A logic page may `return` early.  Returning (or assigning to `err`) an
+aspen.HTTPError responds with that status code, and `response.Redirect` and
+`response.Abort` finish the response; in each case negotiation and rendering
+are skipped.
+
+A panic while serving a request is logged along with its stack and the
+simplate being served, and answered with the site's 500 page, unless the
+response had already started, in which case the connection is dropped.
+
+When Website.Debug is on, 500s are instead answered with a debug page showing
+the error, its stack (with logic page lines mapped back to the simplate by
+line directives in the generated code) and the source around the failing
+line, the request headers and `ctx`.
+
+Successful dynamic responses that are not streamed carry an ETag computed
+from the body, unless the logic page calls `response.SetETag`, and requests
+whose If-None-Match (or If-Modified-Since, against `response.SetLastModified`)
+shows the client's copy to be current get a 304.
+
+Static files (and the canned favicon) carry an ETag and Last-Modified derived
+from their modification time and size, are answered with a 304 when fresh,
+and support single and multiple byte ranges.  The .aspen directory, the site
+index, files and directories matching Website.HiddenPatterns (dotfiles by
+default), configuration scripts and the sources of dynamic simplates are never
+served statically or listed.
+
+Directory listings (see Website.ListDirs) are negotiated as HTML, JSON or
+plain text, may be sorted with `sort` (name, size or mtime) and `order` (asc
+or desc) query parameters, and are split into pages of
+Website.DirListingPageSize entries selected with `page`.  An html/template at
+.aspen/directory-listing.html within the document root overrides the HTML
+listing; being an html/template, it escapes file names and URLs according to
+where they appear.
+
+Responses of a compressible media type (see CompressibleMediaTypes) and at
+least DefaultCompressionMinSize bytes are gzip or deflate compressed according
+to the request's Accept-Encoding header.
+
+Canned error responses are negotiated against the Accept header, giving an
+HTML page, an RFC 7807 application/problem+json body (preferred for JSON
+simplates and .json paths) or plain text.
+
+JSON simplates respond with their `ctx`, less the request data above, unless
+the logic page calls `response.SetBody`.  Output is indented in debug mode or
+when the query string has `pretty`, and logic pages may opt in to JSONP with
+`response.AllowJSONP`.
+
+Simplates with a .sse extension have no template page; their logic page sends
+Server-Sent Events via `events` (an *aspen.EventStream) until it returns or
+`events.Done()` is closed by the client disconnecting.
+
+Simplates with a .ws extension serve WebSockets and likewise have no template
+page.  Their logic page runs once the connection is open, with `socket` (an
+*aspen.WebSocket) on which to send messages and register `socket.OnMessage`
+and `socket.OnClose` functions, which are dispatched to once it returns.
+Requests that are not WebSocket upgrades get a 400.
+
+Site-wide hooks may be placed at .aspen/hooks/inbound.go and
+.aspen/hooks/outbound.go within the document root.  Like simplates, a hook
+file has an optional init page followed by a logic page (separated by ^L), and
+the logic page has access to `request`, `response`, `ctx` and `err`.  Inbound
+hooks run before the logic page of every dynamic resource and may
+short-circuit it by setting `err` or calling `response.Finish()`; outbound
+hooks run just before the response is written, and are skipped for responses
+that have already started streaming.
+
+Error pages may be overridden by simplates at .aspen/<code>.spt (e.g.
+.aspen/404.spt) or .aspen/error.spt for any error status without a page of its
+own.  Their `ctx` holds "code", "status", "error" and "request", and they may
+be negotiated; an error page named without an extension of its own and
+having a single template page is served as HTML.  Hooks are not run for error
+pages, and the canned page is sent if an error page fails to render.
 */
 package aspen
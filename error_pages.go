@@ -0,0 +1,209 @@
+package aspen
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+const (
+	ErrorPageExt     = ".spt"
+	ErrorPageGeneric = "error"
+)
+
+type errorPageContextKey struct{}
+
+type errorPageRequest struct {
+	code   int
+	err    error
+	failed bool
+}
+
+// errorPageWriter buffers an error page so that the canned page may be sent
+// instead if rendering it fails.
+type errorPageWriter struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (me *errorPageWriter) Header() http.Header {
+	return me.header
+}
+
+func (me *errorPageWriter) Write(p []byte) (int, error) {
+	return me.body.Write(p)
+}
+
+func (me *errorPageWriter) WriteHeader(statusCode int) {
+	me.statusCode = statusCode
+}
+
+// RegisterErrorPage registers the handler generated from an error page
+// simplate for the given status code, where 0 means any error status without
+// a page of its own.
+func (me *Website) RegisterErrorPage(code int, filename string,
+	handler http.HandlerFunc) error {
+
+	if code != 0 && (code < 400 || code > 599) {
+		return fmt.Errorf("Invalid status code %v for error page %q!", code, filename)
+	}
+
+	debugf("Registering error page %q for status %v", filename, code)
+
+	me.l.Lock()
+	defer me.l.Unlock()
+
+	if me.errorPages == nil {
+		me.errorPages = map[int]http.HandlerFunc{}
+	}
+
+	me.errorPages[code] = handler
+	return nil
+}
+
+// PrepareErrorPage sets the status code of an error page response and adds
+// "code", "status", "error" and "request" to its context.
+func (me *Website) PrepareErrorPage(request *http.Request,
+	response *HTTPResponseWrapper, ctx map[string]interface{}) {
+
+	info := errorPageFromRequest(request)
+	if info == nil {
+		info = &errorPageRequest{code: http.StatusInternalServerError}
+	}
+
+	response.SetStatusCode(info.code)
+
+	ctx["code"] = info.code
+	ctx["status"] = http.StatusText(info.code)
+	ctx["error"] = info.err
+	ctx["request"] = request
+}
+
+// serveErrorPage renders the site's error page for code, if there is one,
+// returning false if the canned page should be sent instead.
+func (me *Website) serveErrorPage(w http.ResponseWriter, req *http.Request,
+	code int, err error) bool {
+
+	me.l.Lock()
+	handler, ok := me.errorPages[code]
+	if !ok {
+		handler, ok = me.errorPages[0]
+	}
+	me.l.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	info := &errorPageRequest{code: code, err: err}
+	buf := &errorPageWriter{header: http.Header{}, statusCode: code}
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("aspen: panic in error page for %v serving %q: %v\n%s",
+					code, req.URL.Path, r, debug.Stack())
+				info.failed = true
+			}
+		}()
+
+		handler(buf, req.WithContext(context.WithValue(req.Context(),
+			errorPageContextKey{}, info)))
+	}()
+
+	if info.failed {
+		debugf("Error page for %v failed for %q; using canned page",
+			code, req.URL.Path)
+		return false
+	}
+
+	for key, values := range buf.header {
+		w.Header()[key] = values
+	}
+
+	w.WriteHeader(buf.statusCode)
+	w.Write(buf.body.Bytes())
+	return true
+}
+
+func (me *Website) serve404(w http.ResponseWriter, req *http.Request) {
+	if !me.serveErrorPage(w, req, http.StatusNotFound, nil) {
+		serve404(w, req)
+	}
+}
+
+func errorPageFromRequest(req *http.Request) *errorPageRequest {
+	info, _ := req.Context().Value(errorPageContextKey{}).(*errorPageRequest)
+	return info
+}
+
+// respondErrorPage serves the site's error page for code, returning false if
+// the canned page should be sent instead.  Errors while rendering an error
+// page itself always fall back to the canned page of the original error.
+func (me *HTTPResponseWrapper) respondErrorPage(code int, err error) bool {
+	if info := errorPageFromRequest(me.req); info != nil {
+		debugf("Error while rendering error page for %q: %v", me.req.URL.Path, err)
+		info.failed = true
+		return true
+	}
+
+	return me.website.serveErrorPage(me.w, me.req, code, err)
+}
+
+func newErrorPageFromString(packageName, siteRoot, filename,
+	content string) (*simplate, error) {
+
+	name := strings.TrimSuffix(path.Base(filename), ErrorPageExt)
+	codeName := strings.SplitN(name, ".", 2)[0]
+
+	code := 0
+	if codeName != ErrorPageGeneric {
+		var err error
+		code, err = strconv.Atoi(codeName)
+		if err != nil || code < 400 || code > 599 {
+			return nil, fmt.Errorf("Error page %q must be named %v%v or "+
+				"after a 4xx or 5xx status code!", filename, ErrorPageGeneric, ErrorPageExt)
+		}
+	}
+
+	// error pages without an extension of their own are negotiated if they
+	// have more than one template page, and HTML otherwise.
+	if len(path.Ext(name)) == 0 && strings.Count(content, "\f") < 3 {
+		name += ".html"
+	}
+
+	s, err := newSimplateFromString(packageName, siteRoot,
+		path.Join(path.Dir(filename), name), content)
+	if err != nil {
+		return nil, err
+	}
+
+	switch s.Type {
+	case SimplateTypeRendered, SimplateTypeJson, SimplateTypeNegotiated:
+	default:
+		return nil, fmt.Errorf("Error page %q is a %v simplate! "+
+			"Error pages must be rendered, JSON or negotiated.", filename, s.Type)
+	}
+
+	s.AbsFilename, err = filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Filename, err = filepath.Rel(siteRoot, s.AbsFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	s.ErrorPage = true
+	s.ErrorCode = code
+	return s, nil
+}
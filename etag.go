@@ -0,0 +1,92 @@
+package aspen
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SetETag sets the ETag sent with the response instead of one computed from
+// the body, quoting it if needed.
+func (me *HTTPResponseWrapper) SetETag(etag string) {
+	if !strings.HasSuffix(etag, `"`) {
+		etag = `"` + etag + `"`
+	}
+
+	me.SetHeader("ETag", etag)
+}
+
+// SetLastModified sets the Last-Modified header, which is checked against
+// If-Modified-Since when the request has no If-None-Match.
+func (me *HTTPResponseWrapper) SetLastModified(t time.Time) {
+	me.SetHeader("Last-Modified", t.UTC().Format(http.TimeFormat))
+}
+
+// notModified adds an ETag computed from body unless one has been set, and
+// writes a 304 if the request's conditional headers show that the client's
+// copy is current.  Only successful GET and HEAD responses are validated.
+func (me *HTTPResponseWrapper) notModified(body []byte) bool {
+	if me.statusCode != http.StatusOK ||
+		(me.req.Method != "GET" && me.req.Method != "HEAD") {
+		return false
+	}
+
+	header := me.w.Header()
+
+	etag := header.Get("ETag")
+	if len(etag) == 0 {
+		sum := sha1.Sum(body)
+		etag = `"` + hex.EncodeToString(sum[:]) + `"`
+		header.Set("ETag", etag)
+	}
+
+	if !requestIsFresh(me.req, etag, header.Get("Last-Modified")) {
+		return false
+	}
+
+	debugf("Responding 304 Not Modified for %q", me.req.URL.Path)
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+	me.w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+func requestIsFresh(req *http.Request, etag, lastModified string) bool {
+	if inm := req.Header.Get("If-None-Match"); len(inm) > 0 {
+		return etagListMatches(inm, etag)
+	}
+
+	ims := req.Header.Get("If-Modified-Since")
+	if len(ims) == 0 || len(lastModified) == 0 {
+		return false
+	}
+
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+
+	return !modified.After(since)
+}
+
+// etagListMatches compares an If-None-Match list against etag using the weak
+// comparison that RFC 7232 requires for If-None-Match.
+func etagListMatches(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,19 +1,19 @@
 package aspen
 
 import (
-	"fmt"
 	"net/http"
 	"regexp"
 )
 
 const (
-	internalAcceptHeader = "X-AspenGo-Accept"
-	pathTransHeader      = "X-HTTP-Path-Translated"
+	internalAcceptHeader   = "X-AspenGo-Accept"
+	internalSimplateHeader = "X-AspenGo-Simplate"
+	pathTransHeader        = "X-HTTP-Path-Translated"
 )
 
 var (
 	vPathPart    = regexp.MustCompile("%([a-zA-Z_][-a-zA-Z0-9_]*)")
-	vPathPartRep = "(?P<$1>[a-zA-Z_][-a-zA-Z0-9_]*)"
+	vPathPartRep = "(?P<$1>[^/]+)"
 	nonAlNumDash = regexp.MustCompile("[^-a-zA-Z0-9]")
 )
 
@@ -23,6 +23,7 @@ type handlerFuncRegistration struct {
 	Negotiated  bool
 	Virtual     bool
 	Regexp      bool
+	Mounted     bool
 
 	w *Website
 }
@@ -33,9 +34,7 @@ func serve404(w http.ResponseWriter, req *http.Request) {
 		charset = "utf-8"
 	}
 
-	w.Header().Set("Content-Type", fmt.Sprintf("text/html; charset=%v", charset))
-	w.WriteHeader(http.StatusNotFound)
-	w.Write(http404Response)
+	writeCannedError(w, req, charset, &HTTPError{Code: http.StatusNotFound}, false)
 }
 
 // ripped right out of net/http/server.go, matches paths to longest similar
@@ -0,0 +1,194 @@
+package aspen
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	HookKindInbound  = "inbound"
+	HookKindOutbound = "outbound"
+)
+
+var (
+	SiteConfigDirname = ".aspen"
+	SiteHooksDirname  = path.Join(SiteConfigDirname, "hooks")
+	HookKinds         = []string{HookKindInbound, HookKindOutbound}
+
+	siteHookTemplate = escapedSimplateTemplate(siteHookTmpl, "aspen-gen-hook")
+)
+
+// Hook is run around every dynamic resource of a website.  Hooks receive the
+// same `request`, `response` and `ctx` as the simplate's logic page.  An
+// inbound hook may short-circuit the simplate by returning an error or by
+// calling `response.Finish()`.
+type Hook func(request *http.Request, response *HTTPResponseWrapper,
+	ctx map[string]interface{}) error
+
+type websiteHooks struct {
+	inbound  []Hook
+	outbound []Hook
+	l        sync.RWMutex
+}
+
+type siteHook struct {
+	GenPackage  string
+	SiteRoot    string
+	Filename    string
+	AbsFilename string
+	Kind        string
+	InitPage    *simplatePage
+	LogicPage   *simplatePage
+}
+
+// AddInboundHook adds a hook to be run before the logic page of every
+// dynamic resource, in the order in which hooks are added.
+func (me *Website) AddInboundHook(h Hook) {
+	me.hooks.l.Lock()
+	defer me.hooks.l.Unlock()
+
+	me.hooks.inbound = append(me.hooks.inbound, h)
+}
+
+// AddOutboundHook adds a hook to be run after content negotiation and
+// rendering of every dynamic resource, just before the response is written.
+func (me *Website) AddOutboundHook(h Hook) {
+	me.hooks.l.Lock()
+	defer me.hooks.l.Unlock()
+
+	me.hooks.outbound = append(me.hooks.outbound, h)
+}
+
+// RunInboundHooks runs the website's inbound hooks, returning true if the
+// response has been short-circuited and should be written immediately.
+func (me *Website) RunInboundHooks(request *http.Request,
+	response *HTTPResponseWrapper, ctx map[string]interface{}) bool {
+
+	me.hooks.l.RLock()
+	hooks := me.hooks.inbound
+	me.hooks.l.RUnlock()
+
+	for _, h := range hooks {
+		err := h(request, response, ctx)
+		if err != nil {
+			debugf("Inbound hook short-circuiting %q with error: %v",
+				request.URL.Path, err)
+			response.SetError(err)
+			return true
+		}
+
+		if response.Finished() {
+			debugf("Inbound hook short-circuiting %q", request.URL.Path)
+			return true
+		}
+	}
+
+	return false
+}
+
+// RunOutboundHooks runs the website's outbound hooks, stopping at the first
+// hook to return an error.  They are skipped for responses whose headers
+// have already been streamed, as they could no longer change them.
+func (me *Website) RunOutboundHooks(request *http.Request,
+	response *HTTPResponseWrapper, ctx map[string]interface{}) {
+
+	if response.wroteHeader {
+		debugf("Skipping outbound hooks for streamed response to %q",
+			request.URL.Path)
+		return
+	}
+
+	me.hooks.l.RLock()
+	hooks := me.hooks.outbound
+	me.hooks.l.RUnlock()
+
+	for _, h := range hooks {
+		err := h(request, response, ctx)
+		if err != nil {
+			debugf("Outbound hook for %q returned error: %v",
+				request.URL.Path, err)
+			response.SetError(err)
+			return
+		}
+	}
+}
+
+func newSiteHookFromString(packageName, siteRoot, filename,
+	kind, content string) (*siteHook, error) {
+
+	debugf("Creating new %v hook from string for "+
+		"SiteRoot:%q, Filename:%q", kind, siteRoot, filename)
+
+	absFilename, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	filename, err = filepath.Rel(siteRoot, absFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &siteHook{
+		GenPackage:  packageName,
+		SiteRoot:    siteRoot,
+		Filename:    filename,
+		AbsFilename: absFilename,
+		Kind:        kind,
+	}
+
+	rawPages := strings.Split(content, "")
+
+	switch len(rawPages) {
+	case 1:
+		h.InitPage, err = newSimplatePage(nil, "", false)
+		if err != nil {
+			return nil, err
+		}
+
+		h.LogicPage, err = newSimplatePage(nil, rawPages[0], false)
+		if err != nil {
+			return nil, err
+		}
+	case 2:
+		h.InitPage, err = newSimplatePage(nil, rawPages[0], false)
+		if err != nil {
+			return nil, err
+		}
+
+		h.LogicPage, err = newSimplatePage(nil, rawPages[1], false)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("More than 1 ^L found in hook %q! "+
+			"Hooks may only have an init page and a logic page.", filename)
+	}
+
+	return h, nil
+}
+
+func (me *siteHook) Execute(wr io.Writer) (err error) {
+	defer func(err *error) {
+		r := recover()
+		if r != nil {
+			*err = fmt.Errorf("%v", r)
+		}
+	}(&err)
+
+	*(&err) = siteHookTemplate.Execute(wr, me)
+	return
+}
+
+func (me *siteHook) FuncName() string {
+	return strings.ToUpper(me.Kind[:1]) + me.Kind[1:]
+}
+
+func (me *siteHook) OutputName() string {
+	return fmt.Sprintf("aspen-hook-%s.go", me.Kind)
+}
@@ -0,0 +1,195 @@
+package aspen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+
+	"bitbucket.org/ww/goautoneg"
+)
+
+// HTTPError may be returned (or assigned to `err`) by logic pages and hooks to
+// respond with an error status other than 500, skipping negotiation and
+// rendering.  The error page shows Message if one is given.  Codes other than
+// 4xx and 5xx ones are sent as 500.
+type HTTPError struct {
+	Code    int
+	Message string
+}
+
+// problemDetails is the RFC 7807 body of application/problem+json errors.
+type problemDetails struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (me HTTPError) Error() string {
+	if len(me.Message) == 0 {
+		return fmt.Sprintf("%d %s", me.Code, me.Status())
+	}
+
+	return fmt.Sprintf("%d %s: %s", me.Code, me.Status(), me.Message)
+}
+
+func (me HTTPError) Status() string {
+	return http.StatusText(me.Code)
+}
+
+func asHTTPError(err error) (*HTTPError, bool) {
+	switch e := err.(type) {
+	case *HTTPError:
+		return e, true
+	case HTTPError:
+		return &e, true
+	}
+
+	return nil, false
+}
+
+// Abort finishes the response with the given error status (500 if code is
+// not a 4xx or 5xx code), returning the *HTTPError so that logic pages may
+// `return response.Abort(404)`.
+func (me *HTTPResponseWrapper) Abort(code int) error {
+	me.SetError(&HTTPError{Code: me.errorCode(code)})
+	me.Finish()
+	return me.err
+}
+
+// Redirect finishes the response with a redirect to url, using
+// http.StatusFound if code is 0 or not a 3xx code.  Logic pages should
+// `return` afterwards.
+func (me *HTTPResponseWrapper) Redirect(url string, code int) {
+	if code < 300 || code > 399 {
+		if code != 0 {
+			debugf("Redirecting %q with %v instead of non-redirect code %v",
+				me.req.URL.Path, http.StatusFound, code)
+		}
+
+		code = http.StatusFound
+	}
+
+	me.SetHeader("Location", url)
+	me.SetStatusCode(code)
+	me.SetContentType("text/html")
+	me.SetBodyBytes([]byte(fmt.Sprintf("<a href=\"%s\">%s</a>.\n",
+		html.EscapeString(url), http.StatusText(code))))
+	me.Finish()
+}
+
+func (me *HTTPResponseWrapper) respondHTTPError(e *HTTPError) {
+	if code := me.errorCode(e.Code); code != e.Code {
+		e = &HTTPError{Code: code, Message: e.Message}
+	}
+
+	if me.respondErrorPage(e.Code, e) {
+		return
+	}
+
+	me.writeCannedError(e)
+}
+
+// writeCannedError writes the canned error response, preferring JSON for JSON
+// simplates.
+// errorCode returns code if it is a 4xx or 5xx code, or else 500.
+func (me *HTTPResponseWrapper) errorCode(code int) int {
+	if code >= 400 && code <= 599 {
+		return code
+	}
+
+	debugf("Responding to %q with %v instead of non-error code %v",
+		me.req.URL.Path, http.StatusInternalServerError, code)
+	return http.StatusInternalServerError
+}
+
+func (me *HTTPResponseWrapper) writeCannedError(e *HTTPError) {
+	mediaType, _, _ := mime.ParseMediaType(me.contentType)
+	writeCannedError(me.w, me.req, me.website.CharsetDynamic, e,
+		mediaType == "application/json")
+}
+
+// writeCannedError writes an error response negotiated against the request's
+// Accept header: an HTML page, an RFC 7807 application/problem+json body or
+// plain text.  The media type implied by the request path's extension (or
+// preferJSON) decides which is sent when the client accepts anything.
+func writeCannedError(w http.ResponseWriter, req *http.Request, charset string,
+	e *HTTPError, preferJSON bool) {
+
+	mediaType := negotiateErrorMediaType(req, preferJSON)
+
+	var body []byte
+
+	switch mediaType {
+	case "application/problem+json":
+		body, _ = json.Marshal(&problemDetails{
+			Type:   "about:blank",
+			Title:  e.Status(),
+			Status: e.Code,
+			Detail: e.Message,
+		})
+	case "text/plain":
+		mediaType = fmt.Sprintf("text/plain; charset=%v", charset)
+		body = []byte(e.Error() + "\n")
+	default:
+		mediaType = fmt.Sprintf("text/html; charset=%v", charset)
+		body = cannedErrorPage(e)
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(e.Code)
+	w.Write(body)
+}
+
+func negotiateErrorMediaType(req *http.Request, preferJSON bool) string {
+	offers := []string{"text/html", "application/problem+json",
+		"application/json", "text/plain"}
+
+	pathMediaType, _, _ := mime.ParseMediaType(req.Header.Get(internalAcceptHeader))
+	if preferJSON || pathMediaType == "application/json" {
+		offers = []string{"application/problem+json", "application/json",
+			"text/html", "text/plain"}
+	} else if pathMediaType == "text/plain" {
+		offers = []string{"text/plain", "text/html",
+			"application/problem+json", "application/json"}
+	}
+
+	accept := req.Header.Get("Accept")
+	if len(accept) == 0 {
+		accept = "*/*"
+	}
+
+	negotiated := goautoneg.Negotiate(accept, offers)
+	switch negotiated {
+	case "":
+		negotiated = offers[0]
+	case "application/json":
+		negotiated = "application/problem+json"
+	}
+
+	return negotiated
+}
+
+func cannedErrorPage(e *HTTPError) []byte {
+	if len(e.Message) == 0 {
+		switch e.Code {
+		case http.StatusNotFound:
+			return http404Response
+		case http.StatusNotAcceptable:
+			return http406Response
+		case http.StatusInternalServerError:
+			return http500Response
+		}
+	}
+
+	var buf bytes.Buffer
+	err := httpErrorTmpl.Execute(&buf, e)
+	if err != nil {
+		return http500Response
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,133 @@
+package aspen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+)
+
+const (
+	DefaultJSONPCallbackParam = "callback"
+	jsonpCallbackMaxLength    = 128
+)
+
+var (
+	jsonpCallbackPattern = regexp.MustCompile(
+		`^[a-zA-Z_$][a-zA-Z0-9_$]*(\.[a-zA-Z_$][a-zA-Z0-9_$]*)*$`)
+)
+
+// SetDefaultBody sets the body to be marshaled by `RespondJSON` unless one
+// has already been set.  JSON simplates default to their `ctx`, less the
+// standard request data.
+func (me *HTTPResponseWrapper) SetDefaultBody(o interface{}) {
+	if me.bodyObj != nil {
+		return
+	}
+
+	if ctx, ok := o.(map[string]interface{}); ok {
+		o = withoutRequestContext(ctx)
+	}
+
+	me.bodyObj = o
+}
+
+// AllowJSONP opts in to JSONP: if the request's query string has the given
+// parameter (DefaultJSONPCallbackParam if empty), `RespondJSON` wraps the
+// body in a call to the named function.  Callbacks that are not dotted
+// JavaScript identifiers get a 400.
+func (me *HTTPResponseWrapper) AllowJSONP(param string) {
+	if len(param) == 0 {
+		param = DefaultJSONPCallbackParam
+	}
+
+	me.jsonpParam = param
+}
+
+// marshalJSON marshals the body, indenting it in debug mode or if the
+// request has a `pretty` query parameter.  A body set to `ctx` itself is
+// marshaled without the standard request data, as the default body is.
+func (me *HTTPResponseWrapper) marshalJSON() ([]byte, error) {
+	o := me.bodyObj
+	if me.isContext(o) {
+		o = withoutRequestContext(me.ctx)
+	}
+
+	if !me.website.Debug && !me.wantsPrettyJSON() {
+		return json.Marshal(o)
+	}
+
+	body, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(body, '\n'), nil
+}
+
+func (me *HTTPResponseWrapper) isContext(o interface{}) bool {
+	ctx, ok := o.(map[string]interface{})
+	return ok && me.ctx != nil &&
+		reflect.ValueOf(ctx).Pointer() == reflect.ValueOf(me.ctx).Pointer()
+}
+
+func (me *HTTPResponseWrapper) wantsPrettyJSON() bool {
+	values, ok := me.req.URL.Query()["pretty"]
+	if !ok {
+		return false
+	}
+
+	for _, value := range values {
+		if value == "0" || value == "false" {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (me *HTTPResponseWrapper) jsonpCallback() (string, error) {
+	if len(me.jsonpParam) == 0 {
+		return "", nil
+	}
+
+	callback := me.req.URL.Query().Get(me.jsonpParam)
+	if len(callback) == 0 {
+		return "", nil
+	}
+
+	if len(callback) > jsonpCallbackMaxLength || !jsonpCallbackPattern.MatchString(callback) {
+		return "", &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("Invalid JSONP callback %q", callback),
+		}
+	}
+
+	return callback, nil
+}
+
+// jsonContentType adds the dynamic charset to JSON content types without one.
+func (me *HTTPResponseWrapper) jsonContentType() string {
+	_, params, err := mime.ParseMediaType(me.contentType)
+	if err != nil || len(params["charset"]) > 0 {
+		return me.contentType
+	}
+
+	return fmt.Sprintf("%v; charset=%v", me.contentType, me.website.CharsetDynamic)
+}
+
+func wrapJSONP(callback string, body []byte) []byte {
+	var buf bytes.Buffer
+
+	// the leading comment guards against callbacks being used to smuggle a
+	// content-sniffed payload.
+	buf.WriteString("/**/")
+	buf.WriteString(callback)
+	buf.WriteString("(")
+	buf.Write(bytes.TrimRight(body, "\n"))
+	buf.WriteString(");")
+	return buf.Bytes()
+}
@@ -0,0 +1,192 @@
+package aspen
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Middleware wraps an http.Handler, and may be inserted into a website's
+// request pipeline via `Website.Use`, `Website.UsePrefix`, or
+// `Website.UseAt`.
+type Middleware func(http.Handler) http.Handler
+
+// PipelineStage identifies the built-in pipeline stage before which a
+// middleware is inserted.  The built-in stages run in the order string match
+// → pattern → static, so middleware inserted before a later stage only sees
+// requests that fell through the earlier stages.
+type PipelineStage int
+
+const (
+	BeforeStringMatch PipelineStage = iota
+	BeforePattern
+	BeforeStatic
+)
+
+var (
+	pipelineStageNames = map[PipelineStage]string{
+		BeforeStringMatch: "BeforeStringMatch",
+		BeforePattern:     "BeforePattern",
+		BeforeStatic:      "BeforeStatic",
+	}
+)
+
+type middlewareRegistration struct {
+	Prefix     string
+	Middleware Middleware
+}
+
+type websiteMiddlewareHandler struct {
+	w     *Website
+	stage PipelineStage
+
+	nh pipelineHandler
+	r  []*middlewareRegistration
+	h  http.Handler
+	l  sync.RWMutex
+}
+
+func (me PipelineStage) String() string {
+	if name, ok := pipelineStageNames[me]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("PipelineStage(%d)", int(me))
+}
+
+// Use inserts middleware in front of all of the built-in pipeline stages for
+// every request.  Middleware run in the order in which they are added, so the
+// first middleware added is the outermost.
+func (me *Website) Use(mw ...Middleware) {
+	me.UseAt(BeforeStringMatch, "/", mw...)
+}
+
+// UsePrefix is like `Use`, but the middleware only run for requests to the
+// given prefix or paths beneath it, so "/api" covers "/api/orders" but not
+// "/apiary".
+func (me *Website) UsePrefix(prefix string, mw ...Middleware) {
+	me.UseAt(BeforeStringMatch, prefix, mw...)
+}
+
+// UseAt inserts middleware immediately before the given built-in pipeline
+// stage, only running them for requests to the given prefix or paths beneath
+// it.  Middleware at the same stage run in the order in which they are
+// added.
+func (me *Website) UseAt(stage PipelineStage, prefix string, mw ...Middleware) {
+	mh := me.ph.middlewareHandlerAt(stage)
+	if mh == nil {
+		panic(fmt.Errorf("Invalid pipeline stage %v", stage))
+	}
+
+	if len(prefix) == 0 {
+		prefix = "/"
+	}
+
+	for _, m := range mw {
+		if m == nil {
+			continue
+		}
+
+		mh.AddMiddlewareReg(&middlewareRegistration{
+			Prefix:     prefix,
+			Middleware: m,
+		})
+	}
+}
+
+func newWebsiteMiddlewareHandler(w *Website, stage PipelineStage,
+	nh pipelineHandler) *websiteMiddlewareHandler {
+
+	return &websiteMiddlewareHandler{
+		w:     w,
+		stage: stage,
+
+		nh: nh,
+		r:  []*middlewareRegistration{},
+	}
+}
+
+func (me *websiteMiddlewareHandler) NextHandler() pipelineHandler {
+	return me.nh
+}
+
+func (me *websiteMiddlewareHandler) AddMiddlewareReg(reg *middlewareRegistration) {
+	me.l.Lock()
+	defer me.l.Unlock()
+
+	debugf("Middleware handler %v adding middleware for prefix %q",
+		me.stage, reg.Prefix)
+	me.r = append(me.r, reg)
+	me.h = nil
+}
+
+func (me *websiteMiddlewareHandler) handler() http.Handler {
+	me.l.RLock()
+	h := me.h
+	me.l.RUnlock()
+
+	if h != nil {
+		return h
+	}
+
+	me.l.Lock()
+	defer me.l.Unlock()
+
+	if me.h != nil {
+		return me.h
+	}
+
+	var next http.Handler = http.HandlerFunc(me.serveNext)
+
+	for i := len(me.r) - 1; i >= 0; i-- {
+		next = me.r[i].wrap(next)
+	}
+
+	me.h = next
+	return me.h
+}
+
+func (me *websiteMiddlewareHandler) serveNext(w http.ResponseWriter, req *http.Request) {
+	h := me.NextHandler()
+	if h != nil {
+		debugf("Middleware handler %v sending %q to %s", me.stage, req.URL.Path, h)
+		h.ServeHTTP(w, req)
+		return
+	}
+
+	debugf("Middleware handler %v falling through to 404", me.stage)
+	me.w.serve404(w, req)
+}
+
+func (me *websiteMiddlewareHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	me.handler().ServeHTTP(w, req)
+}
+
+func (me *websiteMiddlewareHandler) String() string {
+	me.l.RLock()
+	defer me.l.RUnlock()
+
+	prefixes := []string{}
+	for _, reg := range me.r {
+		prefixes = append(prefixes, reg.Prefix)
+	}
+
+	return fmt.Sprintf("*websiteMiddlewareHandler{stage: %v, prefixes: %v}",
+		me.stage, prefixes)
+}
+
+func (me *middlewareRegistration) wrap(next http.Handler) http.Handler {
+	wrapped := me.Middleware(next)
+	if me.Prefix == "/" {
+		return wrapped
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if mountMatch(me.Prefix, req.URL.Path) {
+			wrapped.ServeHTTP(w, req)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
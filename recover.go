@@ -0,0 +1,56 @@
+package aspen
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// panicError is the error a recovered panic is responded to with.
+type panicError struct {
+	value interface{}
+	stack []byte
+	pcs   []uintptr
+}
+
+func (me *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", me.value)
+}
+
+// recoverPanic is deferred by the pipeline handler so that a panic anywhere
+// in the pipeline is logged and answered with the site's 500 page rather
+// than a dropped connection.  If the response has already been started,
+// there's nothing left to do but abort it.
+func (me *websitePipelineHandler) recoverPanic(cw *compressWriter, req *http.Request) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	if r == http.ErrAbortHandler {
+		panic(r)
+	}
+
+	err := &panicError{value: r, stack: debug.Stack()}
+
+	pcs := make([]uintptr, 64)
+	err.pcs = pcs[:runtime.Callers(2, pcs)]
+
+	simplatePath := req.Header.Get(internalSimplateHeader)
+	if len(simplatePath) == 0 {
+		simplatePath = "(none)"
+	}
+
+	log.Printf("aspen: panic serving %q (simplate %s): %v\n%s",
+		req.URL.Path, simplatePath, r, err.stack)
+
+	if !cw.reset() {
+		panic(http.ErrAbortHandler)
+	}
+
+	response := me.w.NewHTTPResponseWrapper(cw, req)
+	response.SetError(err)
+	response.Respond()
+}
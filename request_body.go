@@ -0,0 +1,178 @@
+package aspen
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+var (
+	// request bodies larger than this get a 413; zero means no limit
+	DefaultMaxBodySize int64 = 10 << 20
+
+	// multipart bodies beyond this much are streamed to temporary files,
+	// which are removed once the request has been handled
+	MaxMultipartMemory int64 = 1 << 20
+)
+
+// RequestBody is the parsed body of a request, found in `ctx` under "body".
+// Form and multipart fields are in Form and uploaded files in Files; JSON
+// bodies are decoded into JSON.
+type RequestBody struct {
+	Form  url.Values
+	Files map[string][]*multipart.FileHeader
+	JSON  interface{}
+
+	multipart *multipart.Form
+}
+
+// ParseRequestBody is called by generated handlers to parse
+// application/x-www-form-urlencoded, multipart/form-data and application/json
+// request bodies into `ctx`, also leaving form values on the request as
+// `request.ParseForm` would.  Bodies larger than Website.MaxBodySize get an
+// HTTPError with a 413, and the connection is closed after the response;
+// malformed ones get a 400.
+func (me *Website) ParseRequestBody(ctx map[string]interface{},
+	w http.ResponseWriter, req *http.Request) (*RequestBody, error) {
+
+	body := &RequestBody{
+		Form:  url.Values{},
+		Files: map[string][]*multipart.FileHeader{},
+	}
+	ctx[CtxKeyBody] = body
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return body, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return body, nil
+	}
+
+	if me.MaxBodySize > 0 {
+		if req.ContentLength > me.MaxBodySize {
+			return body, bodyTooLarge(w)
+		}
+
+		req.Body = http.MaxBytesReader(w, req.Body, me.MaxBodySize)
+	}
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		err = req.ParseForm()
+		body.Form = req.PostForm
+	case "multipart/form-data":
+		err = req.ParseMultipartForm(MaxMultipartMemory)
+		if req.MultipartForm != nil {
+			body.multipart = req.MultipartForm
+			body.Form = url.Values(req.MultipartForm.Value)
+			body.Files = req.MultipartForm.File
+		}
+	case "application/json":
+		decoder := json.NewDecoder(req.Body)
+		decoder.UseNumber()
+		err = decoder.Decode(&body.JSON)
+	default:
+		return body, nil
+	}
+
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return body, bodyTooLarge(w)
+		}
+
+		debugf("Failed to parse %v body for %q: %v", mediaType, req.URL.Path, err)
+		return body, &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("Malformed %v request body.", mediaType),
+		}
+	}
+
+	return body, nil
+}
+
+// bodyTooLarge closes the connection after the response rather than reading
+// the rest of the body, as MaxBytesReader only arranges itself when w is the
+// server's own ResponseWriter, not one wrapped by the pipeline.
+func bodyTooLarge(w http.ResponseWriter) error {
+	w.Header().Set("Connection", "close")
+	return &HTTPError{Code: http.StatusRequestEntityTooLarge}
+}
+
+// Get returns the first value of a form field or, for JSON objects, the
+// value of a member (JSON-encoded unless it's a string).
+func (me *RequestBody) Get(key string) string {
+	values := me.Values(key)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+// Values returns all values of a form field or, for JSON objects, the
+// value of a member (or its items, if it's an array).
+func (me *RequestBody) Values(key string) []string {
+	if me == nil {
+		return nil
+	}
+
+	object, ok := me.JSON.(map[string]interface{})
+	if !ok {
+		return me.Form[key]
+	}
+
+	member, ok := object[key]
+	if !ok {
+		return nil
+	}
+
+	items, ok := member.([]interface{})
+	if !ok {
+		items = []interface{}{member}
+	}
+
+	var values []string
+	for _, item := range items {
+		values = append(values, jsonValueString(item))
+	}
+
+	return values
+}
+
+// File returns the first file uploaded as the given field, if any.
+func (me *RequestBody) File(key string) *multipart.FileHeader {
+	if me == nil || len(me.Files[key]) == 0 {
+		return nil
+	}
+
+	return me.Files[key][0]
+}
+
+// RemoveAll removes any temporary files holding uploads.
+func (me *RequestBody) RemoveAll() error {
+	if me == nil || me.multipart == nil {
+		return nil
+	}
+
+	return me.multipart.RemoveAll()
+}
+
+func jsonValueString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+
+	return string(encoded)
+}
@@ -0,0 +1,123 @@
+package aspen
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Keys under which generated handlers put request data into `ctx` before
+// inbound hooks and the logic page run.  They are reserved: the build rejects
+// simplates with virtual paths of the same name, and the keys are left out of
+// the default body of JSON simplates.
+const (
+	// the parsed request body, as a *RequestBody
+	CtxKeyBody = "body"
+	// the client's session, as a *Session, if sessions are enabled
+	CtxKeySession = "session"
+	// the client's CSRF token, as a string, if CSRF protection is enabled
+	CtxKeyCSRFToken = "csrf_token"
+	// the request path, as a string
+	CtxKeyPath = "path"
+	// the query string values, as url.Values
+	CtxKeyQuery = "query"
+	// the request headers, less those internal to aspen, as http.Header
+	CtxKeyHeaders = "headers"
+	// the request cookies, as a map[string]string of names to values
+	CtxKeyCookies = "cookies"
+	// the media type being rendered, without parameters; empty for negotiated
+	// simplates until negotiation has happened
+	CtxKeyMediaType = "media_type"
+	// the *http.Request
+	CtxKeyRequest = "request"
+	// the *aspen.Website
+	CtxKeyWebsite = "website"
+)
+
+var requestContextKeys = []string{
+	CtxKeyBody,
+	CtxKeySession,
+	CtxKeyCSRFToken,
+	CtxKeyPath,
+	CtxKeyQuery,
+	CtxKeyHeaders,
+	CtxKeyCookies,
+	CtxKeyMediaType,
+	CtxKeyRequest,
+	CtxKeyWebsite,
+}
+
+func isRequestContextKey(name string) bool {
+	for _, key := range requestContextKeys {
+		if name == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UpdateContextFromRequest is called by generated handlers to add the
+// standard request data to `ctx`.  The response keeps hold of `ctx` so that
+// the media type can be updated once negotiated.
+func (me *Website) UpdateContextFromRequest(ctx map[string]interface{},
+	request *http.Request, response *HTTPResponseWrapper) {
+
+	headers := http.Header{}
+	for key, values := range request.Header {
+		if !strings.HasPrefix(strings.ToLower(key), "x-aspengo-") {
+			headers[key] = values
+		}
+	}
+
+	cookies := map[string]string{}
+	for _, cookie := range request.Cookies() {
+		if _, ok := cookies[cookie.Name]; !ok {
+			cookies[cookie.Name] = cookie.Value
+		}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get(internalAcceptHeader))
+
+	ctx[CtxKeyPath] = request.URL.Path
+	ctx[CtxKeyQuery] = request.URL.Query()
+	ctx[CtxKeyHeaders] = headers
+	ctx[CtxKeyCookies] = cookies
+	ctx[CtxKeyMediaType] = mediaType
+	ctx[CtxKeyRequest] = request
+	ctx[CtxKeyWebsite] = me
+
+	if token, ok := csrfTokenFromRequest(request); ok {
+		ctx[CtxKeyCSRFToken] = token
+	}
+
+	response.ctx = ctx
+}
+
+func (me *HTTPResponseWrapper) setContextMediaType(contentType string) {
+	if me.ctx == nil {
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+
+	me.ctx[CtxKeyMediaType] = mediaType
+}
+
+// withoutRequestContext returns a copy of ctx without the standard request
+// data, which has no business in a JSON body.
+func withoutRequestContext(ctx map[string]interface{}) map[string]interface{} {
+	stripped := make(map[string]interface{}, len(ctx))
+	for key, value := range ctx {
+		stripped[key] = value
+	}
+
+	for _, key := range requestContextKeys {
+		delete(stripped, key)
+	}
+
+	return stripped
+}
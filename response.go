@@ -1,11 +1,12 @@
 package aspen
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"net/http"
 	"strings"
+	"time"
 
 	"bitbucket.org/ww/goautoneg"
 )
@@ -34,7 +35,16 @@ type HTTPResponseWrapper struct {
 	contentTypeHandlers map[string]func(*HTTPResponseWrapper)
 	handledContentTypes []string
 
-	err error
+	jsonpParam string
+
+	ctx      map[string]interface{}
+	session  *Session
+	err      error
+	finished bool
+
+	stream      *streamWriter
+	events      *EventStream
+	wroteHeader bool
 }
 
 func newErrHttp406() *errorHttp406 {
@@ -72,39 +82,170 @@ func (me *HTTPResponseWrapper) SetStatusCode(sc int) {
 	me.statusCode = sc
 }
 
+// SetHeader sets a response header, replacing any existing values.  Headers
+// are sent with whichever response is eventually written, error pages
+// included.  Setting Content-Type is the same as calling `SetContentType`.
+func (me *HTTPResponseWrapper) SetHeader(key, value string) {
+	if http.CanonicalHeaderKey(key) == "Content-Type" {
+		me.SetContentType(value)
+		return
+	}
+
+	me.warnIfHeaderWritten(key)
+	me.w.Header().Set(key, value)
+}
+
+// AddHeader adds a value to a response header, keeping any existing values.
+func (me *HTTPResponseWrapper) AddHeader(key, value string) {
+	me.warnIfHeaderWritten(key)
+	me.w.Header().Add(key, value)
+}
+
+// Header returns the headers that will be sent with the response.
+func (me *HTTPResponseWrapper) Header() http.Header {
+	return me.w.Header()
+}
+
+// SetCookie adds a Set-Cookie header, replacing any cookie previously set on
+// this response with the same name and path.  Other Set-Cookie headers, such
+// as those added by middleware, are left alone.
+func (me *HTTPResponseWrapper) SetCookie(cookie *http.Cookie) {
+	me.warnIfHeaderWritten("Set-Cookie")
+	setCookie(me.w.Header(), cookie)
+}
+
+// setCookie adds a Set-Cookie header in place of any with the same name and
+// path, so that middleware setting cookies and the responses they wrap don't
+// lose each other's.
+func setCookie(header http.Header, cookie *http.Cookie) {
+	var lines []string
+	for _, line := range header["Set-Cookie"] {
+		c := parseSetCookie(line)
+		if c == nil || c.Name != cookie.Name || c.Path != cookie.Path {
+			lines = append(lines, line)
+		}
+	}
+
+	header["Set-Cookie"] = append(lines, cookie.String())
+}
+
+func parseSetCookie(line string) *http.Cookie {
+	resp := &http.Response{Header: http.Header{"Set-Cookie": {line}}}
+	cookies := resp.Cookies()
+	if len(cookies) == 0 {
+		return nil
+	}
+
+	return cookies[0]
+}
+
+// DeleteCookie tells the client to discard the cookie with the given name
+// and path.
+func (me *HTTPResponseWrapper) DeleteCookie(name, path string) {
+	me.SetCookie(&http.Cookie{
+		Name:    name,
+		Path:    path,
+		MaxAge:  -1,
+		Expires: time.Unix(0, 0),
+	})
+}
+
+func (me *HTTPResponseWrapper) warnIfHeaderWritten(key string) {
+	if me.wroteHeader {
+		debugf("Ignoring %q header for %q because headers were already written",
+			key, me.req.URL.Path)
+	}
+}
+
 func (me *HTTPResponseWrapper) SetError(err error) {
 	me.err = err
 }
 
+// Finish marks the response as complete.  When called from an inbound hook,
+// the generated handler skips the simplate's logic page, negotiation and
+// rendering, and responds with the status code, content type and body set so
+// far.
+func (me *HTTPResponseWrapper) Finish() {
+	me.finished = true
+}
+
+func (me *HTTPResponseWrapper) Finished() bool {
+	return me.finished
+}
+
 func (me *HTTPResponseWrapper) respond500(err error) {
-	me.w.Header().Set("Content-Type",
-		fmt.Sprintf("text/html; charset=%v", me.website.CharsetDynamic))
+	if me.website.Debug && me.respondDebugPage(http.StatusInternalServerError, err) {
+		return
+	}
+
+	if me.respondErrorPage(http.StatusInternalServerError, err) {
+		return
+	}
+
 	if isDebug {
 		me.w.Header().Set("X-AspenGo-Error", fmt.Sprintf("%v", err))
 	}
-	me.w.WriteHeader(http.StatusInternalServerError)
-	me.w.Write(http500Response)
+
+	me.writeCannedError(&HTTPError{Code: http.StatusInternalServerError})
 }
 
 func (me *HTTPResponseWrapper) respond406(err error) {
-	me.w.Header().Set("Content-Type",
-		fmt.Sprintf("text/html; charset=%v", me.website.CharsetDynamic))
+	if me.respondErrorPage(http.StatusNotAcceptable, err) {
+		return
+	}
+
 	if isDebug {
 		me.w.Header().Set("X-AspenGo-Error", fmt.Sprintf("%v", err))
 	}
 
-	me.w.WriteHeader(http.StatusNotAcceptable)
-	me.w.Write(http406Response)
+	me.writeCannedError(&HTTPError{Code: http.StatusNotAcceptable})
 }
 
-func (me *HTTPResponseWrapper) Respond() {
-	if me.err != nil {
-		if _, ok := me.err.(*errorHttp406); ok {
-			me.respond406(me.err)
-			return
+func (me *HTTPResponseWrapper) respondError() bool {
+	if me.err == nil {
+		return false
+	}
+
+	if _, ok := me.err.(*errorHttp406); ok {
+		me.respond406(me.err)
+		return true
+	}
+
+	if e, ok := asHTTPError(me.err); ok {
+		me.respondHTTPError(e)
+		return true
+	}
+
+	// errors from logic pages that set an error status keep that status.
+	if me.statusCode >= 400 && me.statusCode != http.StatusInternalServerError {
+		if me.respondErrorPage(me.statusCode, me.err) {
+			return true
+		}
+
+		if isDebug {
+			me.w.Header().Set("X-AspenGo-Error", fmt.Sprintf("%v", me.err))
 		}
 
-		me.respond500(me.err)
+		me.writeCannedError(&HTTPError{Code: me.statusCode})
+		return true
+	}
+
+	me.respond500(me.err)
+	return true
+}
+
+func (me *HTTPResponseWrapper) Respond() {
+	me.saveSession()
+
+	if me.finishStream() {
+		return
+	}
+
+	if me.respondError() {
+		return
+	}
+
+	if me.notModified(me.bodyBytes) {
 		return
 	}
 
@@ -114,18 +255,59 @@ func (me *HTTPResponseWrapper) Respond() {
 }
 
 func (me *HTTPResponseWrapper) RespondJSON() {
+	me.saveSession()
+
+	if me.finishStream() {
+		return
+	}
+
+	if me.respondError() {
+		return
+	}
+
+	// finished responses with a body of bytes, such as redirects, or none at
+	// all are sent as is
+	if me.finished && (me.bodyObj == nil || len(me.bodyBytes) > 0) {
+		me.Respond()
+		return
+	}
+
 	if me.bodyObj == nil {
 		me.respond500(errors.New("JSON response body not set!"))
 		return
 	}
 
-	jsonBody, err := json.Marshal(me.bodyObj)
+	if me.Streaming() {
+		me.streamJSON()
+		return
+	}
+
+	callback, err := me.jsonpCallback()
+	if err != nil {
+		me.SetError(err)
+		me.respondError()
+		return
+	}
+
+	jsonBody, err := me.marshalJSON()
 	if err != nil {
 		me.respond500(err)
 		return
 	}
 
-	me.w.Header().Set("Content-Type", "application/json")
+	contentType := me.jsonContentType()
+	if len(callback) > 0 {
+		jsonBody = wrapJSONP(callback, jsonBody)
+		contentType = fmt.Sprintf("application/javascript; charset=%v",
+			me.website.CharsetDynamic)
+		me.w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+
+	if me.notModified(jsonBody) {
+		return
+	}
+
+	me.w.Header().Set("Content-Type", contentType)
 	me.w.WriteHeader(me.statusCode)
 	me.w.Write(jsonBody)
 }
@@ -133,14 +315,39 @@ func (me *HTTPResponseWrapper) RespondJSON() {
 func (me *HTTPResponseWrapper) RegisterContentTypeHandler(contentType string,
 	handlerFunc func(*HTTPResponseWrapper)) {
 
-	me.contentTypeHandlers[contentType] = handlerFunc
-	me.handledContentTypes = append(me.handledContentTypes, contentType)
+	// negotiate on the bare media type, as parameters such as charset are
+	// not considered when matching against the Accept header.
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+
+	me.contentTypeHandlers[mediaType] = handlerFunc
+	me.handledContentTypes = append(me.handledContentTypes, mediaType)
 }
 
 func (me *HTTPResponseWrapper) NegotiateAndCallHandler() {
+	if len(me.handledContentTypes) == 0 {
+		debugf("No content type handlers registered; nothing to negotiate")
+		return
+	}
+
+	// error pages with a single content type are served whatever the original
+	// request accepts.
+	if len(me.handledContentTypes) == 1 && errorPageFromRequest(me.req) != nil {
+		me.setContextMediaType(me.handledContentTypes[0])
+		me.contentTypeHandlers[me.handledContentTypes[0]](me)
+		return
+	}
+
 	accept := me.req.Header.Get(internalAcceptHeader)
 	if len(accept) == 0 {
+		me.AddHeader("Vary", "Accept")
+
 		accept = me.req.Header.Get(http.CanonicalHeaderKey("Accept"))
+		if len(accept) == 0 {
+			accept = "*/*"
+		}
 	}
 
 	debugf("Looking up handler for Accept: %q", accept)
@@ -148,13 +355,20 @@ func (me *HTTPResponseWrapper) NegotiateAndCallHandler() {
 
 	negotiated := goautoneg.Negotiate(accept, me.handledContentTypes)
 	if len(negotiated) == 0 {
-		me.err = http406
-		return
+		fallback := me.website.NegotiationFallback
+		if _, ok := me.contentTypeHandlers[fallback]; !ok {
+			me.err = http406
+			return
+		}
+
+		debugf("Falling back to %q for Accept: %q", fallback, accept)
+		negotiated = fallback
 	}
 
 	handlerFunc, ok := me.contentTypeHandlers[negotiated]
 	if ok {
 		debugf("Calling handler %v for negotiated content type %q", handlerFunc, negotiated)
+		me.setContextMediaType(negotiated)
 		handlerFunc(me)
 	}
 }
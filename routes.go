@@ -0,0 +1,540 @@
+package aspen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+const (
+	RouteKindString  = "string"
+	RouteKindMount   = "mount"
+	RouteKindPattern = "pattern"
+)
+
+var (
+	routeKindPrecedence = map[string]int{
+		RouteKindString:  0,
+		RouteKindMount:   1,
+		RouteKindPattern: 2,
+	}
+)
+
+// Route describes a single registration in a website's request pipeline, as
+// returned by `Website.Routes`.
+type Route struct {
+	RequestPath string
+	Pattern     string
+	Kind        string
+	Negotiated  bool
+	Virtual     bool
+}
+
+type unknownRouteError struct {
+	SimplatePath string
+}
+
+type routeConflictError struct {
+	Prefix      string
+	RequestPath string
+	Kind        string
+}
+
+func (me *unknownRouteError) Error() string {
+	return fmt.Sprintf("No simplate found for route %q", me.SimplatePath)
+}
+
+func (me *routeConflictError) Error() string {
+	return fmt.Sprintf("Mount at %q conflicts with %v route %q",
+		me.Prefix, me.Kind, me.RequestPath)
+}
+
+// Mount serves the given handler for all requests whose path is the given
+// prefix or lies beneath it.  The request path is passed through unchanged,
+// so wrap the handler in `http.StripPrefix` if needed.  Simplates registered
+// at exact paths beneath the prefix take precedence over the mount, and the
+// longest matching mount prefix wins over shorter ones; mounts in turn take
+// precedence over virtual path and negotiated simplates.  An error is
+// returned if the prefix is already claimed by another mount or simplate, or
+// would shadow a pattern registration.
+//
+// A handler mounted at "/" instead serves whatever no simplate, static file
+// or other mount does, so it never conflicts with other routes.
+func (me *Website) Mount(prefix string, handler http.Handler) error {
+	if len(prefix) == 0 || prefix[0] != '/' {
+		return fmt.Errorf("Invalid mount prefix %q", prefix)
+	}
+
+	if handler == nil {
+		return fmt.Errorf("Can't mount nil handler at %q", prefix)
+	}
+
+	if me.ph.strMatchHandler.mountAt(prefix) != nil {
+		return &routeConflictError{prefix, prefix, RouteKindMount}
+	}
+
+	if isRootMount(prefix) {
+		debugf("Mounting %v at the root", handler)
+		return me.ph.strMatchHandler.setRootMount(&handlerFuncRegistration{
+			RequestPath: prefix,
+			HandlerFunc: handler.ServeHTTP,
+			Mounted:     true,
+
+			w: me,
+		})
+	}
+
+	reg := &handlerFuncRegistration{
+		RequestPath: prefix,
+		HandlerFunc: handler.ServeHTTP,
+		Mounted:     true,
+
+		w: me,
+	}
+
+	err := me.ph.checkMountConflicts(reg)
+	if err != nil {
+		return err
+	}
+
+	debugf("Mounting %v at %q", handler, prefix)
+	me.ph.strMatchHandler.AddHandlerFuncReg(prefix, reg)
+	return nil
+}
+
+// Routes lists the website's registered routes in order of precedence.
+func (me *Website) Routes() []*Route {
+	routes := me.ph.strMatchHandler.routes()
+	routes = append(routes, me.ph.patternHandler.routes()...)
+
+	sort.Sort(routeList(routes))
+	return routes
+}
+
+func (me *websitePipelineHandler) checkMountConflicts(mount *handlerFuncRegistration) error {
+	for _, route := range me.strMatchHandler.routes() {
+		if route.Kind == RouteKindMount {
+			if mountPrefix(route.RequestPath) == mountPrefix(mount.RequestPath) &&
+				route.RequestPath != mount.RequestPath {
+				return &routeConflictError{mount.RequestPath, route.RequestPath, route.Kind}
+			}
+
+			continue
+		}
+
+		if pathMatch(mount.RequestPath, route.RequestPath) {
+			return &routeConflictError{mount.RequestPath, route.RequestPath, route.Kind}
+		}
+	}
+
+	for _, route := range me.patternHandler.routes() {
+		if mountMatch(mount.RequestPath, route.RequestPath) {
+			return &routeConflictError{mount.RequestPath, route.RequestPath, route.Kind}
+		}
+	}
+
+	return nil
+}
+
+func (me *websitePipelineHandler) checkRouteConflicts() error {
+	for _, route := range me.strMatchHandler.routes() {
+		if route.Kind != RouteKindMount {
+			continue
+		}
+
+		reg := me.strMatchHandler.mountAt(route.RequestPath)
+		if reg == nil {
+			continue
+		}
+
+		err := me.checkMountConflicts(reg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (me *websiteStringMatchHandler) routes() []*Route {
+	me.l.RLock()
+	defer me.l.RUnlock()
+
+	routes := []*Route{}
+	for requestPath, reg := range me.r {
+		kind := RouteKindString
+		if reg.Mounted {
+			kind = RouteKindMount
+		}
+
+		routes = append(routes, &Route{
+			RequestPath: requestPath,
+			Kind:        kind,
+		})
+	}
+
+	if me.root != nil {
+		routes = append(routes, &Route{
+			RequestPath: me.root.RequestPath,
+			Kind:        RouteKindMount,
+		})
+	}
+
+	return routes
+}
+
+func (me *websiteStringMatchHandler) mountAt(prefix string) *handlerFuncRegistration {
+	me.l.RLock()
+	defer me.l.RUnlock()
+
+	if reg, ok := me.r[prefix]; ok && reg.Mounted {
+		return reg
+	}
+
+	return nil
+}
+
+// rootMount returns the handler mounted at "/", if any.
+func (me *websiteStringMatchHandler) rootMount() *handlerFuncRegistration {
+	me.l.RLock()
+	defer me.l.RUnlock()
+
+	return me.root
+}
+
+func (me *websiteStringMatchHandler) setRootMount(reg *handlerFuncRegistration) error {
+	me.l.Lock()
+	defer me.l.Unlock()
+
+	if me.root != nil {
+		return &routeConflictError{reg.RequestPath, me.root.RequestPath, RouteKindMount}
+	}
+
+	me.root = reg
+	return nil
+}
+
+func (me *websitePatternHandler) routes() []*Route {
+	me.l.RLock()
+	defer me.l.RUnlock()
+
+	routes := []*Route{}
+	for requestPath, reg := range me.r {
+		routes = append(routes, &Route{
+			RequestPath: requestPath,
+			Pattern:     me.c[requestPath].String(),
+			Kind:        RouteKindPattern,
+			Negotiated:  reg.Negotiated,
+			Virtual:     reg.Virtual,
+		})
+	}
+
+	return routes
+}
+
+func (me *Route) String() string {
+	if len(me.Pattern) > 0 {
+		return fmt.Sprintf("%-8s %s (%s)", me.Kind, me.RequestPath, me.Pattern)
+	}
+
+	return fmt.Sprintf("%-8s %s", me.Kind, me.RequestPath)
+}
+
+type routeList []*Route
+
+func (me routeList) Len() int {
+	return len(me)
+}
+
+func (me routeList) Less(i, j int) bool {
+	pi, pj := routeKindPrecedence[me[i].Kind], routeKindPrecedence[me[j].Kind]
+	if pi != pj {
+		return pi < pj
+	}
+
+	if me[i].Kind == RouteKindMount && len(me[i].RequestPath) != len(me[j].RequestPath) {
+		return len(me[i].RequestPath) > len(me[j].RequestPath)
+	}
+
+	return me[i].RequestPath < me[j].RequestPath
+}
+
+func (me routeList) Swap(i, j int) {
+	me[i], me[j] = me[j], me[i]
+}
+
+func mountPrefix(prefix string) string {
+	return strings.TrimRight(prefix, "/")
+}
+
+func isRootMount(prefix string) bool {
+	return len(mountPrefix(prefix)) == 0
+}
+
+// matches the prefix itself and any path beneath it, with or without a
+// trailing slash on either.
+func mountMatch(prefix, p string) bool {
+	trimmed := mountPrefix(prefix)
+	if len(trimmed) == 0 {
+		return true
+	}
+
+	return p == trimmed || strings.HasPrefix(p, trimmed+"/")
+}
+
+// URLFor builds the URL of the simplate at the given path (relative to the
+// document root, e.g. "/falafel/%topping/with/%pairing.txt"), substituting
+// and escaping the virtual path values found in params.  Params which are not
+// virtual path values are added to the query string.  Negotiated simplates
+// may be addressed with an extension, e.g. "/octo.json", and index simplates
+// (including negotiated ones named e.g. "index") are addressed by their
+// directory.  An error is returned if the simplate is not in the site index
+// or a virtual path value is missing, empty or contains a "/".
+func (me *Website) URLFor(simplatePath string, params map[string]interface{}) (string, error) {
+	idx, err := me.loadSiteIndex()
+	if err != nil {
+		return "", err
+	}
+
+	return idx.URLFor(simplatePath, params, me.Indices)
+}
+
+// TemplateFuncs returns the functions available to simplate templates:
+//
+//	urlFor "/falafel/%topping/with/%pairing.txt" "topping" .Topping "pairing" "yogurt"
+//
+// which calls `Website.URLFor` with the given key/value pairs as params.
+func (me *Website) TemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"urlFor": me.urlForTemplateFunc,
+	}
+}
+
+func (me *Website) urlForTemplateFunc(simplatePath string, pairs ...interface{}) (string, error) {
+	if len(pairs)%2 != 0 {
+		return "", fmt.Errorf("urlFor %q: odd number of key/value arguments", simplatePath)
+	}
+
+	params := map[string]interface{}{}
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return "", fmt.Errorf("urlFor %q: key %v is not a string", simplatePath, pairs[i])
+		}
+
+		params[key] = pairs[i+1]
+	}
+
+	return me.URLFor(simplatePath, params)
+}
+
+func (me *Website) loadSiteIndex() (*siteIndex, error) {
+	me.l.Lock()
+	defer me.l.Unlock()
+
+	if me.index != nil {
+		return me.index, nil
+	}
+
+	// the index is written by the build, so a missing or broken one stays
+	// that way; don't read it again on every request.
+	if me.indexErr != nil {
+		return nil, me.indexErr
+	}
+
+	idxPath := path.Join(me.WwwRoot, SiteIndexFilename)
+	debugf("Loading site index from %q", idxPath)
+
+	raw, err := ioutil.ReadFile(idxPath)
+	if err != nil {
+		me.indexErr = err
+		return nil, err
+	}
+
+	idx := &siteIndex{}
+	err = json.Unmarshal(raw, idx)
+	if err != nil {
+		me.indexErr = err
+		return nil, err
+	}
+
+	me.index = idx
+	return me.index, nil
+}
+
+func (me *siteIndex) lookup(simplatePath string) (string, bool) {
+	if _, ok := me.Simplates[simplatePath]; ok {
+		return simplatePath, true
+	}
+
+	ext := path.Ext(simplatePath)
+	if len(ext) == 0 {
+		return "", false
+	}
+
+	summary, ok := me.Simplates[strings.TrimSuffix(simplatePath, ext)]
+	if ok && summary.Type == SimplateTypeNegotiated {
+		return simplatePath, true
+	}
+
+	return "", false
+}
+
+func (me *siteIndex) URLFor(simplatePath string,
+	params map[string]interface{}, indices []string) (string, error) {
+
+	reqPath, ok := me.lookup(simplatePath)
+	if !ok {
+		return "", &unknownRouteError{simplatePath}
+	}
+
+	// negotiated simplates addressed with an extension keep their full path.
+	if summary, ok := me.Simplates[reqPath]; ok {
+		base := path.Base(reqPath)
+
+		for _, idx := range indices {
+			stem := strings.TrimSuffix(idx, path.Ext(idx))
+			if len(idx) > 0 && (base == idx ||
+				(summary.Type == SimplateTypeNegotiated && base == stem)) {
+				reqPath = strings.TrimSuffix(reqPath, base)
+				break
+			}
+		}
+	}
+
+	used := map[string]bool{}
+	segments := strings.Split(reqPath, "/")
+
+	for i, segment := range segments {
+		var missing, invalid, invalidValue string
+
+		segment = vPathPart.ReplaceAllStringFunc(segment, func(part string) string {
+			name := part[1:]
+			value, ok := params[name]
+			if !ok {
+				missing = name
+				return part
+			}
+
+			used[name] = true
+
+			s := fmt.Sprintf("%v", value)
+			if len(s) == 0 || strings.Contains(s, "/") {
+				invalid, invalidValue = name, s
+			}
+
+			return s
+		})
+
+		if len(missing) > 0 {
+			return "", fmt.Errorf("Missing virtual path value %q for route %q",
+				missing, simplatePath)
+		}
+
+		if len(invalid) > 0 {
+			return "", fmt.Errorf("Virtual path value %q=%q for route %q would "+
+				"not be routed", invalid, invalidValue, simplatePath)
+		}
+
+		segments[i] = url.PathEscape(segment)
+	}
+
+	u := strings.Join(segments, "/")
+
+	query := url.Values{}
+	for key, value := range params {
+		if !used[key] {
+			query.Set(key, fmt.Sprintf("%v", value))
+		}
+	}
+
+	if len(query) > 0 {
+		u = u + "?" + query.Encode()
+	}
+
+	return u, nil
+}
+
+// finds the literal simplate paths passed to `urlFor` in a template body.
+func templateRouteReferences(name, body string) ([]string, error) {
+	tree := parse.New(name)
+	tree.Mode = parse.SkipFuncCheck
+
+	_, err := tree.Parse(body, "{{", "}}", map[string]*parse.Tree{})
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []string{}
+	walkTemplateNodes(tree.Root, func(node parse.Node) {
+		cmd, ok := node.(*parse.CommandNode)
+		if !ok || len(cmd.Args) < 2 {
+			return
+		}
+
+		ident, ok := cmd.Args[0].(*parse.IdentifierNode)
+		if !ok || ident.Ident != "urlFor" {
+			return
+		}
+
+		if str, ok := cmd.Args[1].(*parse.StringNode); ok {
+			refs = append(refs, str.Text)
+		}
+	})
+
+	return refs, nil
+}
+
+func walkTemplateNodes(node parse.Node, visit func(parse.Node)) {
+	if node == nil {
+		return
+	}
+
+	visit(node)
+
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+
+		for _, child := range n.Nodes {
+			walkTemplateNodes(child, visit)
+		}
+	case *parse.ActionNode:
+		walkTemplateNodes(n.Pipe, visit)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+
+		for _, cmd := range n.Cmds {
+			walkTemplateNodes(cmd, visit)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			walkTemplateNodes(arg, visit)
+		}
+	case *parse.IfNode:
+		walkTemplateNodes(n.Pipe, visit)
+		walkTemplateNodes(n.List, visit)
+		walkTemplateNodes(n.ElseList, visit)
+	case *parse.RangeNode:
+		walkTemplateNodes(n.Pipe, visit)
+		walkTemplateNodes(n.List, visit)
+		walkTemplateNodes(n.ElseList, visit)
+	case *parse.WithNode:
+		walkTemplateNodes(n.Pipe, visit)
+		walkTemplateNodes(n.List, visit)
+		walkTemplateNodes(n.ElseList, visit)
+	case *parse.TemplateNode:
+		walkTemplateNodes(n.Pipe, visit)
+	}
+}
@@ -0,0 +1,391 @@
+package aspen
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSessionCookieName = "aspen_session"
+
+	// browsers may drop cookies larger than this
+	maxSessionCookieSize = 4096
+)
+
+// SessionStore keeps session values.  The token returned by Save is carried,
+// signed, in the session cookie and passed back to Load and Delete.
+type SessionStore interface {
+	// Load returns the values saved under token, or nil if there are none.
+	Load(token string) (map[string]interface{}, error)
+	// Save saves values under token (which is empty for new sessions) and
+	// returns the token to use from now on.
+	Save(token string, values map[string]interface{}) (string, error)
+	Delete(token string) error
+}
+
+// Sessions configures a website's sessions, which are found in `ctx` under
+// "session".  Tokens are signed with HMAC-SHA256 using the first of Keys and
+// accepted if signed with any of them, so keys may be rotated by prepending a
+// new one and dropping the oldest once sessions signed with it have expired.
+// Without a Store (which configuration scripts can't set), sessions are kept
+// in signed cookies.
+type Sessions struct {
+	Store SessionStore `json:"-"`
+	Keys  [][]byte
+
+	CookieName string
+	Path       string
+	Domain     string
+	// MaxAge is the lifetime of a session in seconds since it was last
+	// saved, or 0 for sessions lasting until the browser is closed.
+	MaxAge   int
+	Secure   bool
+	HTTPOnly bool
+	SameSite http.SameSite
+}
+
+// Session holds the values of one client's session.  Values should be
+// changed with Set and Delete so that the session is saved.
+type Session struct {
+	Values map[string]interface{}
+
+	token     string
+	changed   bool
+	destroyed bool
+	saved     bool
+}
+
+// EnableSessions turns on sessions kept in signed cookies, returning their
+// configuration for further changes (such as a different Store).
+func (me *Website) EnableSessions(keys ...[]byte) *Sessions {
+	me.Sessions = &Sessions{
+		Store:      &CookieSessionStore{},
+		Keys:       keys,
+		CookieName: DefaultSessionCookieName,
+		Path:       "/",
+		HTTPOnly:   true,
+		SameSite:   http.SameSiteLaxMode,
+	}
+
+	return me.Sessions
+}
+
+// LoadSession is called by generated handlers to add the request's session
+// to `ctx`, if sessions are enabled.
+func (me *Website) LoadSession(ctx map[string]interface{},
+	request *http.Request, response *HTTPResponseWrapper) {
+
+	if me.Sessions == nil {
+		return
+	}
+
+	session := me.Sessions.load(request)
+	ctx[CtxKeySession] = session
+	response.session = session
+}
+
+func (me *Sessions) load(req *http.Request) *Session {
+	session := &Session{Values: map[string]interface{}{}}
+
+	cookie, err := req.Cookie(me.CookieName)
+	if err != nil {
+		return session
+	}
+
+	token, ok := me.verify(cookie.Value, time.Now())
+	if !ok {
+		debugf("Ignoring session cookie with bad signature for %q", req.URL.Path)
+		return session
+	}
+
+	values, err := me.store().Load(token)
+	if err != nil {
+		debugf("Failed to load session for %q: %v", req.URL.Path, err)
+		return session
+	}
+
+	if values != nil {
+		session.token = token
+		session.Values = values
+	}
+
+	return session
+}
+
+func (me *Sessions) store() SessionStore {
+	if me.Store == nil {
+		return &CookieSessionStore{}
+	}
+
+	return me.Store
+}
+
+func (me *Sessions) sign(token string, now time.Time) (string, error) {
+	if len(me.Keys) == 0 {
+		return "", fmt.Errorf("No session keys configured!")
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte(token)) + "." +
+		strconv.FormatInt(now.Unix(), 10)
+
+	return payload + "." + me.signature(me.Keys[0], payload), nil
+}
+
+func (me *Sessions) verify(value string, now time.Time) (string, bool) {
+	lastDot := strings.LastIndex(value, ".")
+	if lastDot < 0 {
+		return "", false
+	}
+
+	payload, signature := value[:lastDot], value[lastDot+1:]
+
+	valid := false
+	for _, key := range me.Keys {
+		if hmac.Equal([]byte(signature), []byte(me.signature(key, payload))) {
+			valid = true
+			break
+		}
+	}
+
+	parts := strings.Split(payload, ".")
+	if !valid || len(parts) != 2 {
+		return "", false
+	}
+
+	signedAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", false
+	}
+
+	if me.MaxAge > 0 && now.Unix()-signedAt > int64(me.MaxAge) {
+		return "", false
+	}
+
+	token, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+
+	return string(token), true
+}
+
+func (me *Sessions) signature(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(me.CookieName + "=" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (me *Sessions) cookie(value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     me.CookieName,
+		Value:    value,
+		Path:     me.Path,
+		Domain:   me.Domain,
+		MaxAge:   me.MaxAge,
+		Secure:   me.Secure,
+		HttpOnly: me.HTTPOnly,
+		SameSite: me.SameSite,
+	}
+}
+
+// saveSession saves the session, if changed, and sets the session cookie.
+// It's called just before the response's headers are written.
+func (me *HTTPResponseWrapper) saveSession() {
+	session := me.session
+	if session == nil || session.saved {
+		return
+	}
+
+	session.saved = true
+	sessions := me.website.Sessions
+
+	if session.destroyed {
+		if len(session.token) > 0 {
+			sessions.store().Delete(session.token)
+		}
+
+		me.SetCookie(&http.Cookie{
+			Name:    sessions.CookieName,
+			Path:    sessions.Path,
+			Domain:  sessions.Domain,
+			MaxAge:  -1,
+			Expires: time.Unix(0, 0),
+		})
+		return
+	}
+
+	if !session.changed {
+		return
+	}
+
+	token, err := sessions.store().Save(session.token, session.Values)
+	if err == nil {
+		var value string
+		value, err = sessions.sign(token, time.Now())
+		if err == nil && len(value) > maxSessionCookieSize {
+			err = fmt.Errorf("Session cookie of %v bytes is too large!", len(value))
+		}
+
+		if err == nil {
+			session.token = token
+			me.SetCookie(sessions.cookie(value))
+			return
+		}
+	}
+
+	if me.err == nil {
+		me.err = fmt.Errorf("Failed to save session: %v", err)
+	}
+}
+
+func (me *Session) Get(key string) interface{} {
+	return me.Values[key]
+}
+
+func (me *Session) Set(key string, value interface{}) {
+	me.Values[key] = value
+	me.changed = true
+}
+
+func (me *Session) Delete(key string) {
+	delete(me.Values, key)
+	me.changed = true
+}
+
+// Destroy clears the session and has the client discard its cookie.
+func (me *Session) Destroy() {
+	me.Values = map[string]interface{}{}
+	me.destroyed = true
+}
+
+// IsNew is true for sessions that the client has not sent a cookie for.
+func (me *Session) IsNew() bool {
+	return len(me.token) == 0
+}
+
+// CookieSessionStore keeps session values in the session cookie itself,
+// encoded as JSON (so numbers are loaded as float64s).
+type CookieSessionStore struct{}
+
+func (me *CookieSessionStore) Load(token string) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	err := json.Unmarshal([]byte(token), &values)
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func (me *CookieSessionStore) Save(token string, values map[string]interface{}) (string, error) {
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+
+	return string(encoded), nil
+}
+
+func (me *CookieSessionStore) Delete(token string) error {
+	return nil
+}
+
+// MemorySessionStore keeps session values in memory under random tokens,
+// forgetting them once unused for TTL (if non-zero).  Sessions are lost when
+// the server restarts and are not shared between servers.
+type MemorySessionStore struct {
+	TTL time.Duration
+
+	sessions map[string]*memorySession
+	l        sync.Mutex
+}
+
+type memorySession struct {
+	values  map[string]interface{}
+	touched time.Time
+}
+
+func NewMemorySessionStore(ttl time.Duration) *MemorySessionStore {
+	return &MemorySessionStore{
+		TTL:      ttl,
+		sessions: map[string]*memorySession{},
+	}
+}
+
+func (me *MemorySessionStore) Load(token string) (map[string]interface{}, error) {
+	me.l.Lock()
+	defer me.l.Unlock()
+
+	session, ok := me.sessions[token]
+	if !ok {
+		return nil, nil
+	}
+
+	if me.expired(session, time.Now()) {
+		delete(me.sessions, token)
+		return nil, nil
+	}
+
+	session.touched = time.Now()
+	return copySessionValues(session.values), nil
+}
+
+func (me *MemorySessionStore) Save(token string, values map[string]interface{}) (string, error) {
+	me.l.Lock()
+	defer me.l.Unlock()
+
+	now := time.Now()
+	for t, session := range me.sessions {
+		if me.expired(session, now) {
+			delete(me.sessions, t)
+		}
+	}
+
+	if len(token) == 0 {
+		random := make([]byte, 32)
+		_, err := rand.Read(random)
+		if err != nil {
+			return "", err
+		}
+
+		token = hex.EncodeToString(random)
+	}
+
+	me.sessions[token] = &memorySession{
+		values:  copySessionValues(values),
+		touched: now,
+	}
+
+	return token, nil
+}
+
+func (me *MemorySessionStore) Delete(token string) error {
+	me.l.Lock()
+	defer me.l.Unlock()
+
+	delete(me.sessions, token)
+	return nil
+}
+
+func (me *MemorySessionStore) expired(session *memorySession, now time.Time) bool {
+	return me.TTL > 0 && now.Sub(session.touched) > me.TTL
+}
+
+func copySessionValues(values map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		copied[key] = value
+	}
+
+	return copied
+}
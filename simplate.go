@@ -1,6 +1,7 @@
 package aspen
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"mime"
@@ -15,6 +16,10 @@ const (
 	SimplateTypeStatic     = "static"
 	SimplateTypeNegotiated = "negotiated"
 	SimplateTypeJson       = "json"
+	SimplateTypeSSE        = "sse"
+	SimplateTypeWebSocket  = "websocket"
+
+	webSocketSimplateExt = ".ws"
 )
 
 var (
@@ -22,13 +27,17 @@ var (
 		SimplateTypeJson,
 		SimplateTypeNegotiated,
 		SimplateTypeRendered,
+		SimplateTypeSSE,
 		SimplateTypeStatic,
+		SimplateTypeWebSocket,
 	}
 	simplateTypeTemplates = map[string]*template.Template{
 		SimplateTypeJson:       escapedSimplateTemplate(simplateTypeJSONTmpl, "aspen-gen-json"),
 		SimplateTypeRendered:   escapedSimplateTemplate(simplateTypeRenderedTmpl, "aspen-gen-rendered"),
 		SimplateTypeNegotiated: escapedSimplateTemplate(simplateTypeNegotiatedTmpl, "aspen-gen-negotiated"),
+		SimplateTypeSSE:        escapedSimplateTemplate(simplateTypeSSETmpl, "aspen-gen-sse"),
 		SimplateTypeStatic:     nil,
+		SimplateTypeWebSocket:  escapedSimplateTemplate(simplateTypeWebSocketTmpl, "aspen-gen-websocket"),
 	}
 	defaultRenderer = "#!go/text/template"
 )
@@ -43,12 +52,16 @@ type simplate struct {
 	InitPage      *simplatePage
 	LogicPage     *simplatePage
 	TemplatePages []*simplatePage
+	ErrorPage     bool
+	ErrorCode     int
 }
 
 type simplatePage struct {
 	Parent *simplate
 	Body   string
 	Spec   *simplatePageSpec
+	// the line of the simplate on which the page starts
+	Line int
 }
 
 type simplatePageSpec struct {
@@ -75,6 +88,13 @@ func newSimplateFromString(packageName,
 		return nil, err
 	}
 
+	for _, match := range vPathPart.FindAllStringSubmatch(filename, -1) {
+		if isRequestContextKey(match[1]) {
+			return nil, fmt.Errorf("Virtual path %q in simplate %q is a "+
+				"reserved ctx key!", match[0], filename)
+		}
+	}
+
 	rawPages := strings.Split(content, "")
 	nbreaks := len(rawPages) - 1
 
@@ -106,10 +126,22 @@ func newSimplateFromString(packageName,
 			return nil, err
 		}
 
-		if s.ContentType == "application/json" {
+		s.LogicPage.Line = 1 + strings.Count(rawPages[0], "\n")
+		mediaType, _, _ := mime.ParseMediaType(s.ContentType)
+
+		if ext == webSocketSimplateExt {
+			s.Type = SimplateTypeWebSocket
+		} else if mediaType == "application/json" {
 			s.Type = SimplateTypeJson
+		} else if mediaType == "text/event-stream" {
+			s.Type = SimplateTypeSSE
 		} else {
 			s.Type = SimplateTypeRendered
+			if nbreaks < 2 {
+				return nil, fmt.Errorf("Only 1 ^L found in simplate %q! "+
+					"Rendered simplates must have a template page!", filename)
+			}
+
 			templatePage, err := newSimplatePage(s, rawPages[2], true)
 			if err != nil {
 				return nil, err
@@ -139,6 +171,8 @@ func newSimplateFromString(packageName,
 			return nil, err
 		}
 
+		s.LogicPage.Line = 1 + strings.Count(rawPages[0], "\n")
+
 		for _, rawPage := range rawPages[2:] {
 			templatePage, err := newSimplatePage(s, rawPage, true)
 			if err != nil {
@@ -173,7 +207,14 @@ func (me *simplate) Execute(wr io.Writer) (err error) {
 	}(&err)
 
 	debugf("Executing to %+v\n", wr)
-	*(&err) = simplateTypeTemplates[me.Type].Execute(wr, me)
+
+	var buf bytes.Buffer
+	*(&err) = simplateTypeTemplates[me.Type].Execute(&buf, me)
+	if err != nil {
+		return
+	}
+
+	_, err = wr.Write(resolveGeneratedLineDirectives(buf.Bytes(), me.OutputName()))
 	return
 }
 
@@ -184,7 +225,15 @@ func (me *simplate) escapedFilename() string {
 	lessSpaces := strings.Replace(lessSlashes, " ", "-SPACE-", -1)
 	lessPercents := strings.Replace(lessSpaces, "%", "-PCT-", -1)
 	squeaky := nonAlNumDash.ReplaceAllString(lessPercents, "-")
-	return strings.Replace(squeaky, "--", "-", -1)
+	escaped := strings.Replace(squeaky, "--", "-", -1)
+
+	// error pages live in .aspen, which would otherwise give them a leading
+	// dash and an empty first part in FuncName.
+	if me.ErrorPage {
+		escaped = strings.TrimLeft(escaped, "-")
+	}
+
+	return escaped
 }
 
 func (me *simplate) OutputName() string {
@@ -223,7 +272,7 @@ func newSimplatePageSpec(simplate *simplate, specline string) (*simplatePageSpec
 	switch simplate.Type {
 	case SimplateTypeStatic:
 		return &simplatePageSpec{}, nil
-	case SimplateTypeJson:
+	case SimplateTypeJson, SimplateTypeSSE, SimplateTypeWebSocket:
 		return sps, nil
 	case SimplateTypeRendered:
 		renderer := specline
@@ -1,10 +1,19 @@
 package aspen
 
 import (
+	"bytes"
+	"fmt"
+	"regexp"
 	"strings"
 	"text/template"
 )
 
+const (
+	// replaced with a line directive restoring the generated file's own
+	// positions once the line it's on is known
+	generatedLineDirective = "/*line aspen-generated:1*/"
+)
+
 var (
 	simplateTmplCommonHeader = `
 package {{.GenPackage}}
@@ -25,10 +34,16 @@ import (
 	simplateTmplWebFuncDeclaration = `
     local{{.FuncName}}Website = aspen.DeclareWebsite("{{.GenPackage}}")
 
+    {{if .ErrorPage}}
+    _ = local{{.FuncName}}Website.RegisterErrorPage({{.ErrorCode}},
+        "/{{.Filename}}",
+        SimplateHandlerFunc{{.FuncName}})
+    {{else}}
     _ = local{{.FuncName}}Website.RegisterSimplate("{{.Type}}",
         "{{.SiteRoot}}",
         "/{{.Filename}}",
         SimplateHandlerFunc{{.FuncName}})
+    {{end}}
 `
 	simplateTmplFuncHeader = `
 func SimplateHandlerFunc{{.FuncName}}(w http.ResponseWriter, request *http.Request) {
@@ -37,19 +52,68 @@ func SimplateHandlerFunc{{.FuncName}}(w http.ResponseWriter, request *http.Reque
     website.DebugNewRequest("{{.AbsFilename}}", request)
 
     response := website.NewHTTPResponseWrapper(w, request)
+    {{if eq .Type "json"}}response.SetContentType("application/json"){{end}}
 
     __file__ := "{{.AbsFilename}}"
     ctx := map[string]interface{}{}
+    website.DebugRequestContext(request, ctx)
+    website.UpdateContextFromRequest(ctx, request, response)
+    {{if .ErrorPage}}
+    website.PrepareErrorPage(request, response, ctx)
+    {{else}}
+    website.LoadSession(ctx, request, response)
+
+    __body__, err := website.ParseRequestBody(ctx, w, request)
+    defer __body__.RemoveAll()
+    if err == nil {
+        err = website.CheckCSRFToken(request, __body__)
+    }
+
+    // the build keeps virtual path names clear of the request data above
     website.UpdateContextFromVirtualPaths(&ctx, request.URL.Path, "/{{.Filename}}")
 
-    {{.LogicPage.Body}}
+    if err != nil {
+        response.SetError(err)
+        website.RunOutboundHooks(request, response, ctx)
+        response.Respond()
+        return
+    }
+
+    if website.RunInboundHooks(request, response, ctx) {
+        website.RunOutboundHooks(request, response, ctx)
+        {{if eq .Type "json"}}response.RespondJSON(){{else}}response.Respond(){{end}}
+        return
+    }
+    {{end}}
+    {{if eq .Type "sse"}}
+    events := response.EventStream()
+    defer events.Close()
+    {{end}}
+    {{if eq .Type "websocket"}}
+    socket, err := response.WebSocket()
+    if err != nil {
+        response.Respond()
+        return
+    }
+    defer socket.Close()
+    {{end}}
+
+    // line directives map the logic page back to the simplate for stack
+    // traces and compiler errors
+    err = func() (err error) {
+        /*line {{.AbsFilename}}:{{.LogicPage.Line}}*/{{.LogicPage.Body}}
+        ` + generatedLineDirective + `
+        return
+    }()
 `
 	simplateTmplFuncFooter = `
-    response.NegotiateAndCallHandler()
     if err != nil {
         response.SetError(err)
+    } else if !response.Finished() {
+        response.NegotiateAndCallHandler()
     }
 
+    {{if not .ErrorPage}}website.RunOutboundHooks(request, response, ctx){{end}}
     response.DebugContext(__file__, ctx)
 `
 
@@ -66,7 +130,7 @@ var (
 
     simplateTmplMap{{.FuncName}} = map[string]*template.Template{
         {{range .TemplatePages}}
-        "{{.Spec.ContentType}}": template.Must(template.New("{{.Parent.FuncName}}!{{.Spec.ContentType}}").Parse(__BACKTICK__{{.Body}}__BACKTICK__)),
+        "{{.Spec.ContentType}}": template.Must(template.New("{{.Parent.FuncName}}!{{.Spec.ContentType}}").Funcs(local{{.Parent.FuncName}}Website.TemplateFuncs()).Parse(__BACKTICK__{{.Body}}__BACKTICK__)),
         {{end}}
     }
 
@@ -79,6 +143,16 @@ var (
     response.RegisterContentTypeHandler("{{.Spec.ContentType}}",
         func(response *aspen.HTTPResponseWrapper) {
             tmpl := simplateTmplMap{{.Parent.FuncName}}["{{.Spec.ContentType}}"]
+
+            if response.Streaming() {
+                response.SetContentType("{{.Spec.ContentType}}")
+                err = tmpl.Execute(response.Writer(), ctx)
+                if err != nil {
+                    response.SetError(err)
+                }
+                return
+            }
+
             var tmplBuf bytes.Buffer
 
             err = tmpl.Execute(&tmplBuf, ctx)
@@ -106,12 +180,106 @@ var (
 )
 
 ` + simplateTmplFuncHeader + simplateTmplFuncFooter + `
+    if !response.Finished() {
+        response.SetDefaultBody(ctx)
+    }
     response.RespondJSON()
 }
 `
 	simplateTypeNegotiatedTmpl = simplateTypeRenderedTmpl
+	simplateTypeSSETmpl        = simplateTmplCommonHeader + `
+{{.InitPage.Body}}
+
+var (
+    _ = aspen.EnsureInitialized()
+
+` + simplateTmplWebFuncDeclaration + `
+)
+
+` + simplateTmplFuncHeader + simplateTmplFuncFooter + `
+    events.Close()
+    response.Respond()
+}
+`
+	simplateTypeWebSocketTmpl = simplateTmplCommonHeader + `
+{{.InitPage.Body}}
+
+var (
+    _ = aspen.EnsureInitialized()
+
+` + simplateTmplWebFuncDeclaration + `
 )
 
+` + simplateTmplFuncHeader + `
+    if err != nil {
+        socket.CloseWithReason(aspen.WebSocketCloseInternalError, "")
+    } else {
+        err = socket.Serve()
+    }
+` + simplateTmplFuncFooter + `
+    response.Respond()
+}
+`
+
+	siteHookTmpl = `
+package {{.GenPackage}}
+// GENERATED FILE - DO NOT EDIT
+//
+// Source: {{.AbsFilename}}
+// Type:   {{.Kind}} hook
+//
+// Rebuild with aspen-go-build!
+
+import (
+    "net/http"
+
+    "github.com/gittip/aspen-go"
+)
+
+{{.InitPage.Body}}
+
+var (
+    _ = aspen.EnsureInitialized()
+
+    local{{.FuncName}}HookWebsite = aspen.DeclareWebsite("{{.GenPackage}}")
+)
+
+func init() {
+    local{{.FuncName}}HookWebsite.Add{{.FuncName}}Hook(HookFunc{{.FuncName}})
+}
+
+func HookFunc{{.FuncName}}(request *http.Request,
+    response *aspen.HTTPResponseWrapper, ctx map[string]interface{}) (err error) {
+
+    website := local{{.FuncName}}HookWebsite
+    _ = website
+
+    __file__ := "{{.AbsFilename}}"
+    _ = __file__
+
+    {{.LogicPage.Body}}
+
+    return
+}
+`
+)
+
+// resolveGeneratedLineDirectives points each placeholder line directive (or
+// one already resolved, as the lines may since have been moved by gofmt) at
+// the line of the generated file it's on.
+func resolveGeneratedLineDirectives(source []byte, filename string) []byte {
+	directive := regexp.MustCompile(`/\*line (aspen-generated|` +
+		regexp.QuoteMeta(filename) + `):\d+\*/`)
+
+	lines := bytes.Split(source, []byte("\n"))
+	for i, line := range lines {
+		lines[i] = directive.ReplaceAllLiteral(line,
+			[]byte(fmt.Sprintf("/*line %s:%d*/", filename, i+1)))
+	}
+
+	return bytes.Join(lines, []byte("\n"))
+}
+
 func escapedSimplateTemplate(tmplString, name string) *template.Template {
 	tmpl := template.New(name)
 	escTmplString := strings.Replace(tmplString, "__BACKTICK__", "`", -1)
@@ -0,0 +1,182 @@
+package aspen
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultSSEKeepAliveInterval = 15 * time.Second
+
+	ErrEventStreamClosed = errors.New("Event stream is closed")
+)
+
+// EventStream sends Server-Sent Events over a response, as made available
+// to the logic page of SSE simplates as `events`.  Comment lines are sent as
+// keep-alive pings whenever nothing has been sent for
+// `DefaultSSEKeepAliveInterval`.
+type EventStream struct {
+	rw *HTTPResponseWrapper
+
+	done     chan struct{}
+	closed   bool
+	lastSend time.Time
+	l        sync.Mutex
+}
+
+func init() {
+	mime.AddExtensionType(".sse", "text/event-stream")
+}
+
+// EventStream switches the response into streaming mode with a content type
+// of text/event-stream, returning the stream on which to send events.
+func (me *HTTPResponseWrapper) EventStream() *EventStream {
+	if me.events != nil {
+		return me.events
+	}
+
+	me.SetContentType("text/event-stream")
+	me.SetHeader("Cache-Control", "no-cache")
+	me.Stream()
+
+	me.events = &EventStream{
+		rw: me,
+
+		done:     make(chan struct{}),
+		lastSend: time.Now(),
+	}
+
+	go me.events.keepAlive(DefaultSSEKeepAliveInterval)
+	return me.events
+}
+
+// Send sends an event with the given name (which may be empty for unnamed
+// "message" events).  Strings and byte slices are sent as-is, one data line
+// per line; anything else is sent as JSON.
+func (me *EventStream) Send(event string, data interface{}) error {
+	return me.SendWithID("", event, data)
+}
+
+// SendWithID is like `Send`, but also sets the event ID, which the client
+// sends back as `LastEventID` when reconnecting.
+func (me *EventStream) SendWithID(id, event string, data interface{}) error {
+	var payload string
+
+	switch d := data.(type) {
+	case string:
+		payload = d
+	case []byte:
+		payload = string(d)
+	default:
+		encoded, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+
+		payload = string(encoded)
+	}
+
+	var msg []string
+	if len(id) > 0 {
+		msg = append(msg, "id: "+sseFieldValue(id))
+	}
+
+	if len(event) > 0 {
+		msg = append(msg, "event: "+sseFieldValue(event))
+	}
+
+	for _, line := range strings.Split(payload, "\n") {
+		msg = append(msg, "data: "+strings.TrimSuffix(line, "\r"))
+	}
+
+	return me.write(strings.Join(msg, "\n") + "\n\n")
+}
+
+// SetRetry tells the client how long to wait before reconnecting.
+func (me *EventStream) SetRetry(d time.Duration) error {
+	return me.write(fmt.Sprintf("retry: %d\n\n", d/time.Millisecond))
+}
+
+// LastEventID returns the ID of the last event received by a reconnecting
+// client, from the Last-Event-ID header.
+func (me *EventStream) LastEventID() string {
+	return me.rw.req.Header.Get("Last-Event-ID")
+}
+
+// Done is closed once the client disconnects or the stream is closed, so
+// that logic pages may stop sending events.
+func (me *EventStream) Done() <-chan struct{} {
+	return me.done
+}
+
+// Close stops keep-alive pings and any further sends.  The generated handler
+// closes the stream once the logic page returns.
+func (me *EventStream) Close() {
+	me.l.Lock()
+	defer me.l.Unlock()
+
+	me.close()
+}
+
+func (me *EventStream) close() {
+	if !me.closed {
+		me.closed = true
+		close(me.done)
+	}
+}
+
+func (me *EventStream) write(msg string) error {
+	me.l.Lock()
+	defer me.l.Unlock()
+
+	if me.closed {
+		return ErrEventStreamClosed
+	}
+
+	_, err := me.rw.stream.Write([]byte(msg))
+	if err != nil {
+		debugf("Closing event stream for %q after write error: %v",
+			me.rw.req.URL.Path, err)
+		me.close()
+		return err
+	}
+
+	me.rw.stream.Flush()
+	me.lastSend = time.Now()
+	return nil
+}
+
+func (me *EventStream) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval / 3)
+	defer ticker.Stop()
+
+	disconnected := me.rw.req.Context().Done()
+
+	for {
+		select {
+		case <-me.done:
+			return
+		case <-disconnected:
+			debugf("Client disconnected from event stream %q", me.rw.req.URL.Path)
+			me.Close()
+			return
+		case <-ticker.C:
+			me.l.Lock()
+			idle := time.Since(me.lastSend)
+			me.l.Unlock()
+
+			if idle >= interval {
+				me.write(": keep-alive\n\n")
+			}
+		}
+	}
+}
+
+func sseFieldValue(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
@@ -4,29 +4,41 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"mime"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// names of files and directories (matched with path.Match) that are
+	// never served or listed
+	DefaultHiddenPatterns = []string{".*"}
 )
 
 type websiteStaticHandler struct {
 	w  *Website
 	nh pipelineHandler
-}
 
-type directoryListing struct {
-	RequestPath string
-	FullPath    string
-	Entries     []*directoryListingEntry
+	// the override of the directory listing template, and the modification
+	// time of the file it was parsed from
+	listingTmpl        listingTemplate
+	listingTmplModTime time.Time
+
+	// whether files were found to be simplate sources when there's no site
+	// index, by path
+	sources map[string]*simplateSourceCheck
+	l       sync.Mutex
 }
 
-type directoryListingEntry struct {
-	RequestPath string
-	LinkName    string
-	FileInfo    os.FileInfo
+type simplateSourceCheck struct {
+	modTime time.Time
+	size    int64
+	source  bool
 }
 
 type serveDirError struct {
@@ -57,16 +69,22 @@ func (me *websiteStaticHandler) ServeHTTP(w http.ResponseWriter, req *http.Reque
 		}
 	}
 
+	if mount := me.w.ph.strMatchHandler.rootMount(); mount != nil {
+		debugf("Falling through to the root mount for %q", req.URL.Path)
+		mount.HandlerFunc(w, req)
+		return
+	}
+
 	if strings.HasSuffix(req.URL.Path, "/favicon.ico") {
 		debugf("Serving canned favicon response for %q", req.URL.Path)
 		w.Header().Set("Content-Type", "image/x-icon")
-		w.WriteHeader(http.StatusOK)
-		w.Write(faviconIco)
+		serveStaticContent(w, req, "favicon.ico", cannedModTime,
+			int64(len(faviconIco)), bytes.NewReader(faviconIco))
 		return
 	}
 
 	debugf("Falling through to 404 for %q!", req.URL.Path)
-	serve404(w, req)
+	me.w.serve404(w, req)
 }
 
 func (me *websiteStaticHandler) String() string {
@@ -87,6 +105,11 @@ func (me *websiteStaticHandler) serveStatic(w http.ResponseWriter, req *http.Req
 		return err
 	}
 
+	if me.hidden(fullPath) {
+		debugf("Refusing to serve hidden file %q", fullPath)
+		return os.ErrNotExist
+	}
+
 	if fi.IsDir() {
 		return &serveDirError{Path: fullPath}
 	}
@@ -104,146 +127,217 @@ func (me *websiteStaticHandler) serveStatic(w http.ResponseWriter, req *http.Req
 
 	defer outf.Close()
 
-	w.Header().Set("Content-Length", fmt.Sprintf("%v", fi.Size()))
 	w.Header().Set("Content-Type", ctype)
-	w.WriteHeader(http.StatusOK)
-	io.Copy(w, outf)
+	serveStaticContent(w, req, fi.Name(), fi.ModTime(), fi.Size(), outf)
 
 	return nil
 }
 
-func (me *websiteStaticHandler) serveDirListing(w http.ResponseWriter,
-	req *http.Request) error {
+// serveStaticContent serves content with validators derived from its
+// modification time and size, answering conditional requests with a 304 (or
+// 412) and range requests with a 206 (or 416) as appropriate.
+func serveStaticContent(w http.ResponseWriter, req *http.Request, name string,
+	modTime time.Time, size int64, content io.ReadSeeker) {
 
-	debugf("Serving directory listing for %q", req.URL.Path)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, modTime.UnixNano(), size))
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, req, name, modTime, content)
+}
 
+func (me *websiteStaticHandler) findStaticPath(req *http.Request) (string, error) {
 	fullPath := req.Header.Get(pathTransHeader)
 	if len(fullPath) == 0 {
 		fullPath = path.Join(me.w.WwwRoot, strings.TrimLeft(req.URL.Path, "/"))
 	}
 
 	fi, err := os.Stat(fullPath)
-	if err != nil {
-		return err
+	if _, ok := err.(*os.PathError); ok {
+		debugf("Failed to stat %q: %v", fullPath, err)
+		return "", err
 	}
 
-	if !fi.IsDir() {
-		return fmt.Errorf("%q is not a directory!", fullPath)
-	}
+	if fi.IsDir() {
+		debugf("%q is a directory", fullPath)
 
-	dirListing, err := newDirListing(req.URL.Path, fullPath)
-	if err != nil {
-		return err
+		if idxPath, ok := me.indexFor(fullPath); ok {
+			return idxPath, nil
+		}
 	}
 
-	htmlListing, err := dirListing.Html()
-	if err != nil {
-		return err
+	return fullPath, nil
+}
+
+// indexFor returns the path of the first of the website's index files found
+// in the directory at fullPath.
+func (me *websiteStaticHandler) indexFor(fullPath string) (string, bool) {
+	debugf("Looking for candidate index files.  Configured indices = %+v",
+		me.w.Indices)
+
+	for _, idx := range me.w.Indices {
+		if len(idx) == 0 {
+			continue
+		}
+
+		tryFullPath := path.Join(fullPath, idx)
+
+		debugf("Checking for candidate index file at %q", tryFullPath)
+		fi, err := os.Stat(tryFullPath)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+
+		debugf("Found candidate index file at %q", tryFullPath)
+		return tryFullPath, true
 	}
 
-	w.Header().Set("Content-Length", fmt.Sprintf("%v", len(htmlListing)))
-	w.Header().Set("Content-Type",
-		fmt.Sprintf("text/html; charset=%v", me.w.CharsetDynamic))
-	w.WriteHeader(http.StatusOK)
-	w.Write(htmlListing)
+	return "", false
+}
 
-	return nil
+// hasStaticIndex reports whether the directory at requestPath has an index
+// file that would be served statically.
+func (me *websiteStaticHandler) hasStaticIndex(requestPath string) bool {
+	fullPath := path.Join(me.w.WwwRoot, strings.TrimLeft(requestPath, "/"))
+
+	idxPath, ok := me.indexFor(fullPath)
+	return ok && !me.hidden(idxPath)
 }
 
-func (me *websiteStaticHandler) findStaticPath(req *http.Request) (string, error) {
-	fullPath := req.Header.Get(pathTransHeader)
-	if len(fullPath) == 0 {
-		fullPath = path.Join(me.w.WwwRoot, strings.TrimLeft(req.URL.Path, "/"))
+// hidden is true of files and directories which must never be served
+// statically or listed: the site config directory and index, those matching
+// Website.HiddenPatterns (or within a directory that does), configuration
+// scripts, and the sources of simplates that are not static.  Simplates are
+// looked up in the site index or, without one, recognised by their ^L page
+// breaks as the build would.
+func (me *websiteStaticHandler) hidden(fullPath string) bool {
+	rel, err := filepath.Rel(me.w.WwwRoot, fullPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return true
 	}
 
-	fi, err := os.Stat(fullPath)
-	if _, ok := err.(*os.PathError); ok {
-		debugf("Failed to stat %q: %v", fullPath, err)
-		return "", err
+	if rel == "." {
+		return false
 	}
 
-	if fi.IsDir() {
-		debugf("%q is a directory", fullPath)
-		debugf("Looking for candidate index files.  Configured indices = %+v",
-			me.w.Indices)
-
-		for _, idx := range me.w.Indices {
-			if len(idx) == 0 {
-				continue
-			}
+	rel = filepath.ToSlash(rel)
 
-			tryFullPath := path.Join(fullPath, idx)
+	if rel == SiteIndexFilename || rel == SiteConfigDirname ||
+		strings.HasPrefix(rel, SiteConfigDirname+"/") {
+		return true
+	}
 
-			debugf("Checking for candidate index file at %q", tryFullPath)
-			fi, err := os.Stat(tryFullPath)
-			if err != nil || fi.IsDir() {
-				continue
+	for _, name := range strings.Split(rel, "/") {
+		for _, pattern := range me.w.HiddenPatterns {
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
 			}
-
-			debugf("Found candidate index file at %q", tryFullPath)
-			return tryFullPath, nil
 		}
 	}
 
-	return fullPath, nil
-}
+	if isConfigScript(fullPath) {
+		return true
+	}
 
-func newDirListing(requestPath, dirPath string) (*directoryListing, error) {
-	entries, err := ioutil.ReadDir(dirPath)
+	idx, err := me.w.loadSiteIndex()
 	if err != nil {
-		return nil, err
+		debugf("No site index to check %q against (%v), looking for ^L", fullPath, err)
+		return me.isSimplateSource(fullPath)
 	}
 
-	dlEntries := []*directoryListingEntry{}
+	summary, ok := idx.Simplates["/"+rel]
+	return ok && summary.Type != SimplateTypeStatic
+}
 
-	for _, ent := range entries {
-		reqPath := path.Join(requestPath, ent.Name())
-		linkName := ent.Name()
+// isSimplateSource reports whether the build would treat the file as a
+// dynamic simplate: one with an extension and 1 or 2 ^L, or one without and
+// more.  Files that can't be read are treated as sources.  Files are only
+// scanned again once their modification time or size changes.
+func (me *websiteStaticHandler) isSimplateSource(fullPath string) bool {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return true
+	}
 
-		if ent.IsDir() {
-			reqPath = reqPath + "/"
-			linkName = linkName + "/"
-		}
+	if info.IsDir() {
+		return false
+	}
 
-		dlEnt := &directoryListingEntry{
-			RequestPath: reqPath,
-			LinkName:    linkName,
-			FileInfo:    ent,
-		}
+	me.l.Lock()
+	check, ok := me.sources[fullPath]
+	me.l.Unlock()
 
-		dlEntries = append(dlEntries, dlEnt)
+	if ok && check.modTime.Equal(info.ModTime()) && check.size == info.Size() {
+		return check.source
 	}
 
-	dl := &directoryListing{
-		RequestPath: requestPath,
-		FullPath:    dirPath,
-		Entries:     dlEntries,
+	check = &simplateSourceCheck{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		source:  scanForSimplateSource(fullPath),
 	}
-	return dl, nil
+
+	me.l.Lock()
+	if me.sources == nil {
+		me.sources = map[string]*simplateSourceCheck{}
+	}
+	me.sources[fullPath] = check
+	me.l.Unlock()
+
+	return check.source
 }
 
-func (me *directoryListing) Html() ([]byte, error) {
-	var buf bytes.Buffer
-	err := directoryListingTmpl.Execute(&buf, me)
+func scanForSimplateSource(fullPath string) bool {
+	f, err := os.Open(fullPath)
 	if err != nil {
-		return []byte(""), err
+		return true
+	}
+	defer f.Close()
+
+	hasExt := len(path.Ext(fullPath)) > 0
+	nbreaks := 0
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, err := f.Read(buf)
+		nbreaks += bytes.Count(buf[:n], []byte("\f"))
+		if hasExt && nbreaks > 2 {
+			return false
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return true
+		}
 	}
 
-	return buf.Bytes(), nil
+	if hasExt {
+		return nbreaks > 0
+	}
+
+	return nbreaks > 2
 }
 
-func (me *directoryListing) WebParentDir() string {
-	if me.RequestPath == "/" {
-		return "/"
+func isConfigScript(fullPath string) bool {
+	absPath, err := filepath.Abs(fullPath)
+	if err != nil {
+		return false
 	}
 
-	parDir := path.Dir(strings.TrimRight(me.RequestPath, "/"))
+	for _, script := range strings.Split(os.Getenv("ASPEN_GO_CONFIGURATION_SCRIPTS"), ",") {
+		script = strings.TrimSpace(script)
+		if len(script) == 0 {
+			continue
+		}
 
-	if parDir == "/" {
-		return "/"
+		absScript, err := filepath.Abs(script)
+		if err == nil && absScript == absPath {
+			return true
+		}
 	}
 
-	return parDir + "/"
+	return false
 }
 
 func (me *serveDirError) Error() string {
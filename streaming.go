@@ -0,0 +1,126 @@
+package aspen
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	DefaultStreamFlushInterval = 100 * time.Millisecond
+)
+
+type streamWriter struct {
+	rw *HTTPResponseWrapper
+
+	interval  time.Duration
+	lastFlush time.Time
+	written   int64
+}
+
+func newStreamWriter(rw *HTTPResponseWrapper) *streamWriter {
+	return &streamWriter{
+		rw: rw,
+
+		interval:  DefaultStreamFlushInterval,
+		lastFlush: time.Now(),
+	}
+}
+
+func (me *streamWriter) Write(p []byte) (int, error) {
+	me.rw.writeHeader()
+
+	n, err := me.rw.w.Write(p)
+	me.written += int64(n)
+
+	if time.Since(me.lastFlush) >= me.interval {
+		me.Flush()
+	}
+
+	return n, err
+}
+
+func (me *streamWriter) Flush() {
+	if f, ok := me.rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	me.lastFlush = time.Now()
+}
+
+// Stream switches the response into streaming mode, in which rendered
+// templates and JSON bodies are written directly to the connection (flushing
+// every `DefaultStreamFlushInterval`) rather than being buffered.  The status
+// code, content type and headers must be set before anything is written.
+// Error pages may only be served while nothing has been written yet; errors
+// that happen afterwards are logged and the response is cut short.
+func (me *HTTPResponseWrapper) Stream() {
+	if me.stream == nil {
+		me.stream = newStreamWriter(me)
+	}
+}
+
+func (me *HTTPResponseWrapper) Streaming() bool {
+	return me.stream != nil
+}
+
+// Writer returns an io.Writer that streams directly to the connection,
+// switching the response into streaming mode.  The status code and headers
+// are written on the first write.
+func (me *HTTPResponseWrapper) Writer() io.Writer {
+	me.Stream()
+	return me.stream
+}
+
+// WriteJSON streams the JSON encoding of v followed by a newline, as for
+// newline-delimited JSON (application/x-ndjson) output.
+func (me *HTTPResponseWrapper) WriteJSON(v interface{}) error {
+	return json.NewEncoder(me.Writer()).Encode(v)
+}
+
+// Flush sends anything written so far to the client.
+func (me *HTTPResponseWrapper) Flush() {
+	if me.stream != nil {
+		me.stream.Flush()
+	}
+}
+
+func (me *HTTPResponseWrapper) writeHeader() {
+	if me.wroteHeader {
+		return
+	}
+
+	me.saveSession()
+	me.w.Header().Set("Content-Type", me.contentType)
+	me.w.WriteHeader(me.statusCode)
+	me.wroteHeader = true
+}
+
+// finishes a response that has already started streaming, returning false if
+// nothing has been written yet.
+func (me *HTTPResponseWrapper) finishStream() bool {
+	if !me.wroteHeader {
+		return false
+	}
+
+	if me.err != nil {
+		log.Printf("aspen: error after streaming response for %q: %v",
+			me.req.URL.Path, me.err)
+	}
+
+	me.Flush()
+	return true
+}
+
+func (me *HTTPResponseWrapper) streamJSON() {
+	err := json.NewEncoder(me.Writer()).Encode(me.bodyObj)
+	if err != nil {
+		me.err = err
+	}
+
+	if !me.finishStream() {
+		me.respond500(err)
+	}
+}
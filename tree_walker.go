@@ -15,6 +15,9 @@ var (
 type treeWalker struct {
 	PackageName string
 	Root        string
+
+	// the error that stopped the walk, set before the nil simplate is sent
+	err error
 }
 
 func newTreeWalker(packageName, rootDir string) (*treeWalker, error) {
@@ -54,6 +57,11 @@ func (me *treeWalker) Simplates() (<-chan *simplate, error) {
 				debugf("Tree walker checking path at %q", info.Name())
 
 				if info.IsDir() {
+					if path == filepath.Join(me.Root, SiteConfigDirname) {
+						debugf("Tree walker skipping site config dir %q", path)
+						return filepath.SkipDir
+					}
+
 					return nil
 				}
 
@@ -73,6 +81,7 @@ func (me *treeWalker) Simplates() (<-chan *simplate, error) {
 
 		if err != nil {
 			debugf("Tree walker error: %+v", err)
+			me.err = err
 			schan <- nil
 			*(&topErr) = err
 		}
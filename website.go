@@ -20,6 +20,7 @@ var (
 	DefaultCharsetDynamic = "utf-8"
 	DefaultCharsetStatic  = DefaultCharsetDynamic
 	DefaultContentType    = "application/octet-stream"
+	FormatQueryParam      = "format"
 	DefaultIndicesArray   = []string{"index.html", "index.json", "index.txt"}
 	DefaultIndices        = strings.Join(DefaultIndicesArray, ",")
 	DefaultConfig         = &WebsiteConfigurer{}
@@ -36,6 +37,9 @@ var (
 		Indices:            DefaultIndicesArray,
 		ListDirs:           false,
 		Debug:              false,
+		MaxBodySize:        DefaultMaxBodySize,
+		HiddenPatterns:     DefaultHiddenPatterns,
+		DirListingPageSize: DefaultDirListingPageSize,
 	}
 )
 
@@ -46,14 +50,38 @@ type Website struct {
 	CharsetDynamic     string
 	CharsetStatic      string
 	DefaultContentType string
-	Indices            []string
-	ListDirs           bool
+	// NegotiationFallback is served when none of a negotiated simplate's
+	// media types is acceptable, rather than a 406, if the simplate has it.
+	NegotiationFallback string
+	Indices             []string
+	ListDirs            bool
+	// DirListingPageSize is the number of entries in each page of a
+	// directory listing, or 0 to list every entry on one page.
+	DirListingPageSize int
 	Debug              bool
+	// HiddenPatterns name files and directories that are never served
+	// statically or listed, in addition to .aspen, the site index and
+	// simplate sources.
+	HiddenPatterns []string
+	// MaxBodySize is the largest request body, in bytes, that is parsed
+	// into `ctx` before a 413 is sent, or 0 for no limit.
+	MaxBodySize int64
+	// Sessions are off unless configured, e.g. via EnableSessions.
+	Sessions *Sessions
+	// CSRF protection is off unless configured, e.g. via EnableCSRF.
+	CSRF *CSRF
 
 	configured bool
+	usingCSRF  bool
 
-	s  *serverContext
-	ph *websitePipelineHandler
+	s        *serverContext
+	ph       *websitePipelineHandler
+	hooks    *websiteHooks
+	index    *siteIndex
+	indexErr error
+	l        sync.Mutex
+
+	errorPages map[int]http.HandlerFunc
 }
 
 type pipelineHandler interface {
@@ -69,16 +97,19 @@ type websitePipelineHandler struct {
 	r  map[string]*handlerFuncRegistration
 	l  sync.RWMutex
 
-	patternHandler  *websitePatternHandler
-	strMatchHandler *websiteStringMatchHandler
+	patternHandler     *websitePatternHandler
+	strMatchHandler    *websiteStringMatchHandler
+	staticHandler      *websiteStaticHandler
+	middlewareHandlers map[PipelineStage]*websiteMiddlewareHandler
 }
 
 type websiteStringMatchHandler struct {
 	w *Website
 
-	nh pipelineHandler
-	r  map[string]*handlerFuncRegistration
-	l  sync.RWMutex
+	nh   pipelineHandler
+	r    map[string]*handlerFuncRegistration
+	root *handlerFuncRegistration
+	l    sync.RWMutex
 }
 
 type websitePatternHandler struct {
@@ -120,37 +151,61 @@ func DeclareWebsite(packageName string) *Website {
 		PackageName: packageName,
 		WwwRoot:     protoWebsite.WwwRoot,
 
-		CharsetDynamic: protoWebsite.CharsetDynamic,
-		CharsetStatic:  protoWebsite.CharsetStatic,
-		Indices:        protoWebsite.Indices,
-		ListDirs:       protoWebsite.ListDirs,
-		Debug:          protoWebsite.Debug,
+		CharsetDynamic:     protoWebsite.CharsetDynamic,
+		CharsetStatic:      protoWebsite.CharsetStatic,
+		Indices:            protoWebsite.Indices,
+		ListDirs:           protoWebsite.ListDirs,
+		Debug:              protoWebsite.Debug,
+		MaxBodySize:        protoWebsite.MaxBodySize,
+		HiddenPatterns:     protoWebsite.HiddenPatterns,
+		DirListingPageSize: protoWebsite.DirListingPageSize,
+		Sessions:           protoWebsite.Sessions,
+		CSRF:               protoWebsite.CSRF,
+
+		NegotiationFallback: protoWebsite.NegotiationFallback,
 	}
 	staticHandler := &websiteStaticHandler{
 		w: newSite,
 	}
+	staticMiddleware := newWebsiteMiddlewareHandler(newSite,
+		BeforeStatic, staticHandler)
 	patternHandler := &websitePatternHandler{
 		w: newSite,
 
 		r:  map[string]*handlerFuncRegistration{},
 		c:  map[string]*regexp.Regexp{},
-		nh: staticHandler,
+		nh: staticMiddleware,
 	}
+	patternMiddleware := newWebsiteMiddlewareHandler(newSite,
+		BeforePattern, patternHandler)
 	strMatchHandler := &websiteStringMatchHandler{
 		w: newSite,
 		r: map[string]*handlerFuncRegistration{},
 
-		nh: patternHandler,
+		nh: patternMiddleware,
 	}
+	strMatchMiddleware := newWebsiteMiddlewareHandler(newSite,
+		BeforeStringMatch, strMatchHandler)
 	ph := &websitePipelineHandler{
 		w: newSite,
 
-		nh: strMatchHandler,
+		nh: strMatchMiddleware,
 	}
 
 	ph.patternHandler = patternHandler
 	ph.strMatchHandler = strMatchHandler
+	ph.staticHandler = staticHandler
+	ph.middlewareHandlers = map[PipelineStage]*websiteMiddlewareHandler{
+		BeforeStringMatch: strMatchMiddleware,
+		BeforePattern:     patternMiddleware,
+		BeforeStatic:      staticMiddleware,
+	}
 	newSite.ph = ph
+	newSite.hooks = &websiteHooks{}
+
+	if newSite.CSRF != nil {
+		newSite.useCSRF()
+	}
 
 	websites[packageName] = newSite
 
@@ -266,21 +321,16 @@ func (me *websitePipelineHandler) NewHandlerFuncRegistration(requestPath,
 	isVirtual := vPathPart.MatchString(requestPath)
 	debugf("Setting `Virtual` to %v for %q", isVirtual, requestPath)
 
-	if simplateType == SimplateTypeNegotiated {
-		// directly add a 404 for the non-pattern path, which may be tho wrong
-		// behavior, but at least we aren't serving the simplate source.
-		me.strMatchHandler.AddHandlerFuncReg(requestPath,
-			&handlerFuncRegistration{
-				RequestPath: requestPath,
-				HandlerFunc: serve404,
-			})
-		return me.patternHandler.NewHandlerFuncRegistration(requestPath,
+	if simplateType == SimplateTypeNegotiated || isVirtual {
+		reg := me.patternHandler.NewHandlerFuncRegistration(requestPath,
 			simplateType, handler, isDir, isVirtual)
-	}
 
-	if isVirtual {
-		return me.patternHandler.NewHandlerFuncRegistration(requestPath,
-			simplateType, handler, isDir, isVirtual)
+		if simplateType == SimplateTypeNegotiated && !isVirtual &&
+			me.w.isIndexStem(path.Base(requestPath)) {
+			me.strMatchHandler.addNegotiatedIndex(requestPath, handler)
+		}
+
+		return reg
 	}
 
 	return me.strMatchHandler.NewHandlerFuncRegistration(requestPath,
@@ -303,7 +353,8 @@ func (me *websitePatternHandler) NewHandlerFuncRegistration(requestPath,
 	}
 
 	if simplateType == SimplateTypeNegotiated {
-		pathRegexp := requestPathPattern + "\\.[^\\.]+"
+		// negotiated simplates are served both with and without an extension
+		pathRegexp := requestPathPattern + "(\\.[^\\./]+)?"
 		debugf("Registering %q as a negotiated simplate", pathRegexp)
 
 		me.AddHandlerFuncReg(requestPath, &handlerFuncRegistration{
@@ -373,9 +424,81 @@ func (me *websiteStringMatchHandler) NewHandlerFuncRegistration(requestPath,
 		}
 	}
 
+	debugf("Registering %q at its own request path", requestPath)
+	me.AddHandlerFuncReg(requestPath, &handlerFuncRegistration{
+		RequestPath: requestPath,
+		HandlerFunc: handler,
+
+		w: me.w,
+	})
+
+	if reg == nil {
+		reg = me.r[requestPath]
+	}
+
 	return reg
 }
 
+// addNegotiatedIndex registers a negotiated index simplate at its directory,
+// unless a rendered index has already claimed it.  Static index files are
+// looked for when the directory is requested, as they are not registered, and
+// served in preference to the negotiated index.
+func (me *websiteStringMatchHandler) addNegotiatedIndex(requestPath string,
+	handler http.HandlerFunc) {
+
+	pathDir := path.Dir(requestPath)
+	reqPath := strings.TrimSuffix(pathDir, "/") + "/"
+
+	me.l.Lock()
+	defer me.l.Unlock()
+
+	if existing, ok := me.r[reqPath]; ok && !existing.Negotiated {
+		debugf("Not registering negotiated index %q at %q, which is taken",
+			requestPath, reqPath)
+		return
+	}
+
+	debugf("Registering %q as negotiated index of %q", requestPath, reqPath)
+	me.r[reqPath] = &handlerFuncRegistration{
+		RequestPath: reqPath,
+		HandlerFunc: func(w http.ResponseWriter, req *http.Request) {
+			if me.w.ph.staticHandler.hasStaticIndex(reqPath) {
+				debugf("Serving static index of %q rather than %q",
+					reqPath, requestPath)
+				me.w.ph.middlewareHandlers[BeforeStatic].ServeHTTP(w, req)
+				return
+			}
+
+			handler(w, req)
+		},
+		Negotiated: true,
+
+		w: me.w,
+	}
+
+	if _, ok := me.r[pathDir]; !ok && pathDir != reqPath {
+		me.r[pathDir] = &handlerFuncRegistration{
+			RequestPath: pathDir,
+			HandlerFunc: http.RedirectHandler(reqPath, http.StatusMovedPermanently).ServeHTTP,
+
+			w: me.w,
+		}
+	}
+}
+
+// isIndexStem reports whether name is one of the website's index filenames
+// without its extension, as negotiated index simplates are named.
+func (me *Website) isIndexStem(name string) bool {
+	for _, idx := range me.Indices {
+		stem := strings.TrimSuffix(idx, path.Ext(idx))
+		if len(stem) > 0 && stem == name {
+			return true
+		}
+	}
+
+	return false
+}
+
 func virtualToRegexp(requestPath string) string {
 	return vPathPart.ReplaceAllString(requestPath, vPathPartRep)
 }
@@ -385,7 +508,7 @@ func (me *websitePipelineHandler) registerSpecialCases() {
 	debugf("Registering special case of %q -> 404", idxPath)
 	me.strMatchHandler.AddHandlerFuncReg(idxPath, &handlerFuncRegistration{
 		RequestPath: idxPath,
-		HandlerFunc: serve404,
+		HandlerFunc: me.w.serve404,
 	})
 }
 
@@ -401,6 +524,8 @@ func (me *Website) Configure(serverBind, wwwRoot, charsetDynamic,
 		charsetDynamic, charsetStatic, indices, debug, listDirs)
 
 	me.WwwRoot = wwwRoot
+	me.index = nil
+	me.indexErr = nil
 	me.CharsetDynamic = charsetDynamic
 	me.CharsetStatic = charsetStatic
 	me.ListDirs = listDirs
@@ -436,10 +561,18 @@ func (me *websitePipelineHandler) NextHandler() pipelineHandler {
 func (me *websitePipelineHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	me.injectCustomHeaders(req)
 
+	if me.w.Debug {
+		req = withDebugInfo(req)
+	}
+
+	cw := newCompressWriter(w, req)
+	defer cw.Close()
+	defer me.recoverPanic(cw, req)
+
 	h := me.NextHandler()
 	if h != nil {
 		debugf("Pipeline handler sending %q to %s", req.URL.Path, h)
-		h.ServeHTTP(w, req)
+		h.ServeHTTP(cw, req)
 	}
 }
 
@@ -447,24 +580,62 @@ func (me *websitePipelineHandler) String() string {
 	return fmt.Sprintf("*websitePipelineHandler{"+
 		"patternHandler: %s, "+
 		"strMatchHandler: %s, "+
-		"r: %+v}", me.patternHandler, me.strMatchHandler, me.r)
+		"middlewareHandlers: %v, "+
+		"r: %+v}", me.patternHandler, me.strMatchHandler,
+		me.middlewareHandlers, me.r)
+}
+
+func (me *websitePipelineHandler) middlewareHandlerAt(stage PipelineStage) *websiteMiddlewareHandler {
+	if mh, ok := me.middlewareHandlers[stage]; ok {
+		return mh
+	}
+
+	return nil
 }
 
 func (me *websitePipelineHandler) injectCustomHeaders(req *http.Request) {
 	me.updateNegType(req, req.URL.Path)
+	req.Header.Del(internalSimplateHeader)
 	req.Header.Set("X-AspenGo-PackageName", me.w.PackageName)
 	req.Header.Set("X-AspenGo-WwwRoot", me.w.WwwRoot)
 	req.Header.Set("X-AspenGo-CharsetStatic", me.w.CharsetStatic)
 	req.Header.Set("X-AspenGo-CharsetDynamic", me.w.CharsetDynamic)
 }
 
+// updateNegType sets the media type to negotiate from the request path's
+// extension.  Paths without an extension are negotiated from the client's
+// Accept header, unless overridden by a `format` query parameter holding an
+// extension or media type.
 func (me *websitePipelineHandler) updateNegType(req *http.Request, filename string) {
-	mediaType := mime.TypeByExtension(path.Ext(filename))
+	req.Header.Del(internalAcceptHeader)
+
+	ext := path.Ext(filename)
+	if len(ext) == 0 {
+		format := req.URL.Query().Get(FormatQueryParam)
+		if len(format) == 0 {
+			return
+		}
+
+		mediaType := mime.TypeByExtension("." + format)
+		if len(mediaType) == 0 && strings.Contains(format, "/") {
+			mediaType = format
+		}
+
+		if len(mediaType) > 0 {
+			req.Header.Set(internalAcceptHeader, mediaType)
+		}
+
+		return
+	}
+
+	mediaType := mime.TypeByExtension(ext)
 	if len(mediaType) == 0 {
 		mediaType = me.w.DefaultContentType
 	}
 
-	req.Header.Set(internalAcceptHeader, mediaType)
+	if len(mediaType) > 0 {
+		req.Header.Set(internalAcceptHeader, mediaType)
+	}
 }
 
 func (me *websitePatternHandler) NextHandler() pipelineHandler {
@@ -479,7 +650,7 @@ func (me *websitePatternHandler) AddHandlerFuncReg(requestPath string,
 			"replacing with 404 handler", requestPath)
 		r = &handlerFuncRegistration{
 			RequestPath: requestPath,
-			HandlerFunc: serve404,
+			HandlerFunc: me.w.serve404,
 
 			w: me.w,
 		}
@@ -487,15 +658,15 @@ func (me *websitePatternHandler) AddHandlerFuncReg(requestPath string,
 
 	debugf("Adding handler func registration for %q: %+v", requestPath, r)
 
-	me.l.RLock()
-	defer me.l.RUnlock()
+	me.l.Lock()
+	defer me.l.Unlock()
 
 	if _, ok := me.r[requestPath]; ok {
 		debugf("Ignoring additional registration for %q", requestPath)
 		return
 	}
 
-	me.c[requestPath] = regexp.MustCompile(r.RequestPath)
+	me.c[requestPath] = regexp.MustCompile("^" + r.RequestPath + "$")
 
 	debugf("Setting handler for %q", requestPath)
 	me.r[requestPath] = r
@@ -531,7 +702,7 @@ func (me *websitePatternHandler) ServeHTTP(w http.ResponseWriter, req *http.Requ
 	}
 
 	debugf("Pattern handler falling through to 404 because next handler is %v", h)
-	serve404(w, req)
+	me.w.serve404(w, req)
 }
 
 func (me *websitePatternHandler) String() string {
@@ -565,7 +736,7 @@ func (me *websiteStringMatchHandler) ServeHTTP(w http.ResponseWriter, req *http.
 	}
 
 	debugf("String match handler falling through to 404")
-	serve404(w, req)
+	me.w.serve404(w, req)
 	return
 }
 
@@ -580,8 +751,8 @@ func (me *websiteStringMatchHandler) NextHandler() pipelineHandler {
 func (me *websiteStringMatchHandler) AddHandlerFuncReg(requestPath string,
 	reg *handlerFuncRegistration) {
 
-	me.l.RLock()
-	defer me.l.RUnlock()
+	me.l.Lock()
+	defer me.l.Unlock()
 
 	debugf("String match handler adding func reg at %q: %+v",
 		requestPath, reg)
@@ -589,10 +760,23 @@ func (me *websiteStringMatchHandler) AddHandlerFuncReg(requestPath string,
 }
 
 func (me *websiteStringMatchHandler) match(requestPath string) *handlerFuncRegistration {
-	var h *handlerFuncRegistration
+	me.l.RLock()
+	defer me.l.RUnlock()
+
+	var h, m *handlerFuncRegistration
 
 	n := 0
+	mn := 0
 	for k, v := range me.r {
+		if v.Mounted {
+			if mountMatch(k, requestPath) && (m == nil || len(k) > mn) {
+				mn = len(k)
+				m = v
+			}
+
+			continue
+		}
+
 		if !pathMatch(k, requestPath) {
 			continue
 		}
@@ -603,6 +787,10 @@ func (me *websiteStringMatchHandler) match(requestPath string) *handlerFuncRegis
 		}
 	}
 
+	if h == nil {
+		h = m
+	}
+
 	debugf("String match handler 'match' returning %+v", h)
 	return h
 }
@@ -640,28 +828,31 @@ func (me *Website) RunServer() error {
 		return fmt.Errorf("Can't run the server when we aren't configured!")
 	}
 
+	err := me.ph.checkRouteConflicts()
+	if err != nil {
+		return err
+	}
+
 	me.ph.registerSpecialCases()
 	me.ph.registerSelfAtRoot()
 
 	if isDebug {
 		debugf("Website about to run server with pipeline:\n\t%s", me.ph)
 
-		debugf("String matches registered:")
-		for m, _ := range me.ph.strMatchHandler.r {
-			debugf("    %s", m)
-		}
-
-		debugf("Patterns registered:")
-		for _, re := range me.ph.patternHandler.c {
-			debugf("    %s", re)
+		debugf("Routes registered:")
+		for _, route := range me.Routes() {
+			debugf("    %s", route)
 		}
 	}
 
 	return me.s.Run()
 }
 
+// DebugNewRequest is called by generated handlers as they start on a request,
+// and remembers the simplate handling it for logging should it panic.
 func (me *Website) DebugNewRequest(simplatePath string, req *http.Request) {
 	debugf("%q handling new request %q", simplatePath, req.URL)
+	req.Header.Set(internalSimplateHeader, simplatePath)
 }
 
 func (me *WebsiteConfigurer) Load(r io.Reader) (*Website, error) {
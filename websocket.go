@@ -0,0 +1,474 @@
+package aspen
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	WebSocketCloseNormal          = 1000
+	WebSocketCloseGoingAway       = 1001
+	WebSocketCloseProtocolError   = 1002
+	WebSocketCloseUnsupportedData = 1003
+	WebSocketCloseNoStatus        = 1005
+	WebSocketCloseAbnormal        = 1006
+	WebSocketCloseInvalidPayload  = 1007
+	WebSocketClosePolicyViolation = 1008
+	WebSocketCloseMessageTooBig   = 1009
+	WebSocketCloseInternalError   = 1011
+
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+var (
+	DefaultWebSocketMaxMessageSize int64 = 1 << 20
+
+	ErrWebSocketClosed = errors.New("WebSocket is closed")
+)
+
+// WebSocket is a server-side RFC 6455 connection, as made available to the
+// logic page of WebSocket simplates as `socket`.  The logic page runs once
+// the connection is open; messages may then be read with `Receive`, or
+// handled by a function passed to `OnMessage`, which the generated handler
+// dispatches to once the logic page returns.
+type WebSocket struct {
+	req  *http.Request
+	conn net.Conn
+	brw  *bufio.ReadWriter
+
+	MaxMessageSize int64
+
+	onMessage func(*WebSocketMessage)
+	onClose   func(code int, reason string)
+
+	closed    bool
+	closeSent bool
+	closeOnce sync.Once
+	wl        sync.Mutex
+	l         sync.Mutex
+}
+
+type WebSocketMessage struct {
+	Binary bool
+	Data   []byte
+}
+
+// WebSocketCloseError is returned by `Receive` once the connection has been
+// closed, carrying the close code and reason.
+type WebSocketCloseError struct {
+	Code   int
+	Reason string
+}
+
+type webSocketHandshakeError struct {
+	msg string
+}
+
+func (me *webSocketHandshakeError) Error() string {
+	return "WebSocket handshake failed: " + me.msg
+}
+
+func (me *WebSocketCloseError) Error() string {
+	return fmt.Sprintf("WebSocket closed with code %d %q", me.Code, me.Reason)
+}
+
+func (me *WebSocketMessage) Text() string {
+	return string(me.Data)
+}
+
+// WebSocket completes the WebSocket opening handshake and takes over the
+// connection.  If the request is not a valid WebSocket upgrade, the response
+// is set up as a 400 and an error returned.  Once the connection has been
+// taken over nothing more may be written through the response wrapper.
+func (me *HTTPResponseWrapper) WebSocket() (*WebSocket, error) {
+	accept, err := webSocketAccept(me.req)
+	if err != nil {
+		me.SetStatusCode(http.StatusBadRequest)
+		me.SetContentType("text/plain")
+		me.SetBodyBytes([]byte(err.Error() + "\n"))
+		return nil, err
+	}
+
+	hj, ok := me.w.(http.Hijacker)
+	if !ok {
+		err = errors.New("WebSocket: response does not support hijacking")
+		me.SetError(err)
+		return nil, err
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		me.SetError(err)
+		return nil, err
+	}
+
+	// the 101 below is the only response on this connection.
+	me.wroteHeader = true
+
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+
+	err = brw.Flush()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	debugf("WebSocket opened for %q", me.req.URL.Path)
+
+	return &WebSocket{
+		req:  me.req,
+		conn: conn,
+		brw:  brw,
+
+		MaxMessageSize: DefaultWebSocketMaxMessageSize,
+	}, nil
+}
+
+func webSocketAccept(req *http.Request) (string, error) {
+	if req.Method != "GET" {
+		return "", &webSocketHandshakeError{"method must be GET"}
+	}
+
+	if !headerHasToken(req.Header, "Connection", "upgrade") ||
+		!headerHasToken(req.Header, "Upgrade", "websocket") {
+		return "", &webSocketHandshakeError{"not a WebSocket upgrade request"}
+	}
+
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		return "", &webSocketHandshakeError{"unsupported Sec-WebSocket-Version"}
+	}
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 16 {
+		return "", &webSocketHandshakeError{"invalid Sec-WebSocket-Key"}
+	}
+
+	h := sha1.New()
+	io.WriteString(h, key+webSocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (me *WebSocket) Request() *http.Request {
+	return me.req
+}
+
+// OnMessage sets the function called with each message received by `Serve`.
+func (me *WebSocket) OnMessage(f func(*WebSocketMessage)) {
+	me.onMessage = f
+}
+
+// OnClose sets the function called once when the connection closes, with the
+// close code and reason (WebSocketCloseAbnormal if the connection dropped).
+func (me *WebSocket) OnClose(f func(code int, reason string)) {
+	me.onClose = f
+}
+
+// Serve dispatches received messages to the `OnMessage` function until the
+// connection closes.  The generated handler calls it once the logic page
+// returns.
+func (me *WebSocket) Serve() error {
+	for {
+		msg, err := me.Receive()
+		if err != nil {
+			if _, ok := err.(*WebSocketCloseError); ok || err == ErrWebSocketClosed {
+				return nil
+			}
+
+			return err
+		}
+
+		if me.onMessage != nil {
+			me.onMessage(msg)
+		}
+	}
+}
+
+func (me *WebSocket) SendText(text string) error {
+	return me.writeFrame(wsOpText, []byte(text))
+}
+
+func (me *WebSocket) SendBinary(data []byte) error {
+	return me.writeFrame(wsOpBinary, data)
+}
+
+func (me *WebSocket) SendJSON(v interface{}) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return me.SendText(string(encoded))
+}
+
+func (me *WebSocket) Ping(data []byte) error {
+	return me.writeFrame(wsOpPing, data)
+}
+
+// Close closes the connection normally.
+func (me *WebSocket) Close() error {
+	return me.CloseWithReason(WebSocketCloseNormal, "")
+}
+
+// CloseWithReason sends a close frame with the given code and reason, then
+// closes the connection.
+func (me *WebSocket) CloseWithReason(code int, reason string) error {
+	me.l.Lock()
+	alreadySent := me.closeSent
+	me.closeSent = true
+	me.closed = true
+	me.l.Unlock()
+
+	var err error
+	if !alreadySent {
+		payload := []byte{}
+		if code != WebSocketCloseNoStatus {
+			payload = make([]byte, 2, 2+len(reason))
+			binary.BigEndian.PutUint16(payload, uint16(code))
+			payload = append(payload, reason...)
+		}
+
+		err = me.writeFrame(wsOpClose, payload)
+	}
+
+	me.conn.Close()
+	me.finish(code, reason)
+	return err
+}
+
+// Receive reads the next text or binary message, answering pings and
+// reassembling fragmented messages.  Once the connection closes a
+// *WebSocketCloseError is returned.
+func (me *WebSocket) Receive() (*WebSocketMessage, error) {
+	var msg *WebSocketMessage
+
+	for {
+		if me.isClosed() {
+			return nil, ErrWebSocketClosed
+		}
+
+		fin, opcode, payload, err := me.readFrame()
+		if err != nil {
+			if closeErr, ok := err.(*WebSocketCloseError); ok {
+				me.CloseWithReason(closeErr.Code, closeErr.Reason)
+				return nil, closeErr
+			}
+
+			if me.isClosed() {
+				return nil, ErrWebSocketClosed
+			}
+
+			me.conn.Close()
+			me.finish(WebSocketCloseAbnormal, "")
+			return nil, &WebSocketCloseError{Code: WebSocketCloseAbnormal}
+		}
+
+		switch opcode {
+		case wsOpPing:
+			me.writeFrame(wsOpPong, payload)
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			return nil, me.receivedClose(payload)
+		case wsOpText, wsOpBinary:
+			if msg != nil {
+				return nil, me.failWith(WebSocketCloseProtocolError,
+					"expected continuation frame")
+			}
+
+			msg = &WebSocketMessage{Binary: opcode == wsOpBinary, Data: payload}
+		case wsOpContinuation:
+			if msg == nil {
+				return nil, me.failWith(WebSocketCloseProtocolError,
+					"unexpected continuation frame")
+			}
+
+			if int64(len(msg.Data)+len(payload)) > me.MaxMessageSize {
+				return nil, me.failWith(WebSocketCloseMessageTooBig, "")
+			}
+
+			msg.Data = append(msg.Data, payload...)
+		default:
+			return nil, me.failWith(WebSocketCloseProtocolError, "unknown opcode")
+		}
+
+		if fin {
+			if !msg.Binary && !utf8.Valid(msg.Data) {
+				return nil, me.failWith(WebSocketCloseInvalidPayload, "")
+			}
+
+			return msg, nil
+		}
+	}
+}
+
+func (me *WebSocket) receivedClose(payload []byte) error {
+	closeErr := &WebSocketCloseError{Code: WebSocketCloseNoStatus}
+
+	if len(payload) == 1 {
+		return me.failWith(WebSocketCloseProtocolError, "")
+	}
+
+	if len(payload) >= 2 {
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+	}
+
+	debugf("WebSocket for %q received close %d %q",
+		me.req.URL.Path, closeErr.Code, closeErr.Reason)
+	me.CloseWithReason(closeErr.Code, "")
+	return closeErr
+}
+
+func (me *WebSocket) failWith(code int, reason string) error {
+	debugf("WebSocket for %q failing with %d %q", me.req.URL.Path, code, reason)
+	me.CloseWithReason(code, reason)
+	return &WebSocketCloseError{Code: code, Reason: reason}
+}
+
+func (me *WebSocket) isClosed() bool {
+	me.l.Lock()
+	defer me.l.Unlock()
+
+	return me.closed
+}
+
+func (me *WebSocket) finish(code int, reason string) {
+	me.closeOnce.Do(func() {
+		if me.onClose != nil {
+			me.onClose(code, reason)
+		}
+	})
+}
+
+func (me *WebSocket) readFrame() (bool, byte, []byte, error) {
+	var hdr [2]byte
+
+	_, err := io.ReadFull(me.brw, hdr[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := hdr[0]&0x80 != 0
+	opcode := hdr[0] & 0x0f
+
+	if hdr[0]&0x70 != 0 {
+		return false, 0, nil, &WebSocketCloseError{WebSocketCloseProtocolError, "reserved bits set"}
+	}
+
+	if hdr[1]&0x80 == 0 {
+		return false, 0, nil, &WebSocketCloseError{WebSocketCloseProtocolError, "client frames must be masked"}
+	}
+
+	length := uint64(hdr[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(me.brw, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(me.brw, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	if opcode >= wsOpClose && (length > 125 || !fin) {
+		return false, 0, nil, &WebSocketCloseError{WebSocketCloseProtocolError, "invalid control frame"}
+	}
+
+	if length > uint64(me.MaxMessageSize) {
+		return false, 0, nil, &WebSocketCloseError{WebSocketCloseMessageTooBig, ""}
+	}
+
+	var mask [4]byte
+	_, err = io.ReadFull(me.brw, mask[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(me.brw, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+func (me *WebSocket) writeFrame(opcode byte, payload []byte) error {
+	me.wl.Lock()
+	defer me.wl.Unlock()
+
+	if opcode != wsOpClose && me.isClosed() {
+		return ErrWebSocketClosed
+	}
+
+	hdr := []byte{0x80 | opcode}
+	length := len(payload)
+
+	switch {
+	case length <= 125:
+		hdr = append(hdr, byte(length))
+	case length <= 0xffff:
+		hdr = append(hdr, 126, 0, 0)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(length))
+	default:
+		hdr = append(hdr, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(hdr[2:], uint64(length))
+	}
+
+	_, err := me.brw.Write(hdr)
+	if err != nil {
+		return err
+	}
+
+	_, err = me.brw.Write(payload)
+	if err != nil {
+		return err
+	}
+
+	return me.brw.Flush()
+}